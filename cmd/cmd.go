@@ -12,9 +12,11 @@ import (
 )
 
 const (
-	Env_GIN_MODE               = "GIN_MODE"     // The deployment mode, e.g. debug, release, test
-	Env_DATABASE_URL           = "DATABASE_URL" // The database connection string.
+	Env_GIN_MODE               = "GIN_MODE"             // The deployment mode, e.g. debug, release, test
+	Env_DATABASE_URL           = "DATABASE_URL"         // The database connection string.
+	Env_DATABASE_REPLICA_URL   = "DATABASE_REPLICA_URL" // An optional read replica connection string.
 	Env_COOKIE_ENCRYPTION_KEYS = "COOKIE_ENCRYPTION_KEYS"
+	Env_BASE_URL               = "BASE_URL" // The public URL of the web server, e.g. for the OpenAPI document.
 )
 
 var (
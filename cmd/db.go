@@ -2,12 +2,14 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 	"webapp/db"
 	"webapp/models"
@@ -25,7 +27,11 @@ func init() {
 	dbCmd.AddCommand(executeCmd)
 	dbCmd.AddCommand(generateCmd)
 	dbCmd.AddCommand(migrateCmd)
+	dbCmd.AddCommand(rollbackCmd)
 	dbCmd.AddCommand(seedCmd)
+	dbCmd.AddCommand(purgeCmd)
+
+	migrateCmd.AddCommand(migrateStatusCmd)
 
 	executeCmd.Flags().BoolVarP(&optDbExecuteCommit,
 		"commit", "", false, "commit the transaction instead of rolling back")
@@ -34,12 +40,36 @@ func init() {
 		"csv", "c", false, "format result set as CSV instead of JSON")
 	selectCmd.Flags().StringVarP(&optDbSelectCsvSep,
 		"sep", "s", ",", "separator to use for CSV output")
+
+	migrateCmd.Flags().Int64VarP(&optDbMigrateTo,
+		"to", "", 0, "migrate up to and including this version instead of the latest")
+	migrateCmd.Flags().BoolVarP(&optDbMigrateDryRun,
+		"dry-run", "", false, "print the SQL that would run instead of executing it")
+	migrateCmd.Flags().BoolVarP(&optDbMigrateForceUnlock,
+		"force-unlock", "", false, "release the migrations lock left by a crashed process before migrating")
+
+	rollbackCmd.Flags().IntVarP(&optDbRollbackSteps,
+		"steps", "n", 1, "number of applied migrations to roll back")
+	rollbackCmd.Flags().Int64VarP(&optDbRollbackTo,
+		"to", "", 0, "roll back every migration newer than this version")
+	rollbackCmd.MarkFlagsMutuallyExclusive("steps", "to")
+	rollbackCmd.Flags().BoolVarP(&optDbMigrateDryRun,
+		"dry-run", "", false, "print the SQL that would run instead of executing it")
+
+	purgeCmd.Flags().DurationVarP(&optDbPurgeRetention,
+		"retention", "r", defaultDbPurgeRetention, "how long to keep deleted users before purging them")
 }
 
 var (
-	optDbExecuteCommit   = false
-	optDbSelectCsvOutput = false
-	optDbSelectCsvSep    = ","
+	optDbExecuteCommit      = false
+	optDbSelectCsvOutput    = false
+	optDbSelectCsvSep       = ","
+	optDbMigrateTo          = int64(0)
+	optDbMigrateDryRun      = false
+	optDbMigrateForceUnlock = false
+	optDbRollbackSteps      = 1
+	optDbRollbackTo         = int64(0)
+	optDbPurgeRetention     = defaultDbPurgeRetention
 )
 
 var dbCmd = &cobra.Command{
@@ -105,8 +135,10 @@ var selectCmd = &cobra.Command{
 		// Execute the query.
 		dburl := util.MustEnv(Env_DATABASE_URL)
 		db := must1(db.Connect(dburl))
+		db.QueryTimeout = 0 // Ad hoc queries may take as long as they need.
 		log.Printf("executing query:\n\n    %v\n\n", query)
 		rows := must1(db.Query(query))
+		defer rows.Close()
 
 		// Inspect the result set column types.
 		columns := must1(rows.Columns())
@@ -144,6 +176,7 @@ var selectCmd = &cobra.Command{
 				must(enc.Encode(util.OrderedJsonObj{Keys: columns, Values: values}))
 			}
 		}
+		must(rows.Err())
 
 		if outputcsv {
 			w.Flush()
@@ -160,28 +193,106 @@ var migrateCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		dburl := util.MustEnv(Env_DATABASE_URL)
 		db := must1(db.Connect(dburl))
-		must(db.Migrate())
+		if optDbMigrateDryRun {
+			printMigrationSteps(must1(db.PlanMigrateTo(optDbMigrateTo)))
+			return
+		}
+		if optDbMigrateForceUnlock {
+			must(db.ForceUnlockMigrations())
+			log.Printf("released the migrations lock")
+		}
+		must(db.MigrateTo(optDbMigrateTo))
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:     "status",
+	Aliases: []string{"st"},
+	Short:   "Show which database migrations are applied, pending, or modified",
+	Run: func(cmd *cobra.Command, args []string) {
+		dburl := util.MustEnv(Env_DATABASE_URL)
+		db := must1(db.Connect(dburl))
+		statuses := must1(db.MigrationStatuses())
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATE\tFILENAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "-"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", status.Version, status.State, status.Filename, appliedAt)
+		}
+		must(w.Flush())
+	},
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:     "rollback",
+	Aliases: []string{"rb"},
+	Short:   "Undo the most recently applied database migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		dburl := util.MustEnv(Env_DATABASE_URL)
+		db := must1(db.Connect(dburl))
+		switch {
+		case optDbMigrateDryRun && cmd.Flags().Changed("to"):
+			printMigrationSteps(must1(db.PlanRollbackTo(optDbRollbackTo)))
+		case optDbMigrateDryRun:
+			printMigrationSteps(must1(db.PlanRollback(optDbRollbackSteps)))
+		case cmd.Flags().Changed("to"):
+			must(db.RollbackTo(optDbRollbackTo))
+		default:
+			must(db.Rollback(optDbRollbackSteps))
+		}
 	},
 }
 
+// Print the planned migration SQL for a dry-run.
+func printMigrationSteps(steps []db.MigrationStep) {
+	for _, step := range steps {
+		if step.Migration.IsGo() {
+			fmt.Printf("-- %v (Go function, no SQL to show)\n", step.Filename())
+			continue
+		}
+		fmt.Printf("-- %v\n%v\n", step.Filename(), strings.TrimSpace(step.Query()))
+	}
+	log.Printf("dry-run: %v database migration(s) would run", len(steps))
+}
+
 var seedCmd = &cobra.Command{
 	Use:     "seed",
 	Aliases: []string{"sd"},
 	Short:   "Seed the database with example data",
 	Run: func(cmd *cobra.Command, args []string) {
 		dburl := util.MustEnv(Env_DATABASE_URL)
-		db := must1(db.Connect(dburl))
-		must(db.Migrate())
+		dbh := must1(db.Connect(dburl))
+		must(dbh.Migrate())
 		password := "secret"
 		user := models.User{
 			Email:    "hello@example.com",
 			Password: password,
 		}
 		log.Printf("creating user %v:%v", user.Email, user.Password)
-		query := "INSERT INTO users (email, password) VALUES ($1, $2)"
-		if _, err := db.Exec(query, user.Email, web.BCryptPassword(user.Password)); err != nil {
+		user.Password = must1(web.BCryptPassword(user.Password))
+		if _, err := db.NewUserRepository(dbh).Create(context.Background(), user); err != nil {
 			log.Fatalf("%v", err)
 		}
 		log.Printf("successfully seeded database")
 	},
 }
+
+const defaultDbPurgeRetention = 30 * 24 * time.Hour
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Permanently remove users deleted longer ago than the retention period",
+	Long: `Permanently remove users deleted longer ago than the retention period
+(30 days by default), which can no longer be restored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dburl := util.MustEnv(Env_DATABASE_URL)
+		dbh := must1(db.Connect(dburl))
+		before := time.Now().Add(-optDbPurgeRetention)
+		n := must1(db.NewUserRepository(dbh).Purge(context.Background(), before))
+		log.Printf("purged %v user(s) deleted before %v", n, before.UTC().Format(time.RFC3339))
+	},
+}
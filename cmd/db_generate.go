@@ -1,12 +1,13 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"go/format"
+	"go/token"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
 	"webapp/db"
 
 	"github.com/iancoleman/strcase"
@@ -15,85 +16,455 @@ import (
 	cobra "github.com/spf13/cobra"
 )
 
+func init() {
+	generateCmd.Flags().StringVarP(&optDbGenerateConfig,
+		"config", "c", defaultGenerateConfigFilename, "JSON file overriding the Go types of columns")
+	generateCmd.Flags().StringVarP(&optDbGenerateSchema,
+		"schema", "", defaultGenerateSchema, "the database schema of the tables")
+	generateCmd.Flags().StringSliceVarP(&optDbGenerateInclude,
+		"include", "i", nil, "only generate tables matching these globs, like the table arguments")
+	generateCmd.Flags().StringSliceVarP(&optDbGenerateExclude,
+		"exclude", "x", nil, "skip tables matching these globs")
+	generateCmd.Flags().BoolVarP(&optDbGenerateDryRun,
+		"dry-run", "", false, "print a unified diff of the changes instead of writing them")
+	generateCmd.Flags().BoolVarP(&optDbGenerateCheck,
+		"check", "", false, "exit non-zero if any generated file is out of date")
+	generateCmd.MarkFlagsMutuallyExclusive("dry-run", "check")
+}
+
+var (
+	optDbGenerateConfig  = defaultGenerateConfigFilename
+	optDbGenerateSchema  = defaultGenerateSchema
+	optDbGenerateInclude = []string{}
+	optDbGenerateExclude = []string{}
+	optDbGenerateDryRun  = false
+	optDbGenerateCheck   = false
+)
+
+const (
+	defaultGenerateConfigFilename = "./db/generate.json"
+	defaultGenerateSchema         = "public"
+
+	generatedModelsDirname = "./models"
+	generatedDbDirname     = "./db"
+	generatedWebDirname    = "./web"
+
+	generatedFileSuffix     = "_gen.go"
+	generatedRoutesBasename = "routes"
+	generatedEnumsBasename  = "enums"
+)
+
 var generateCmd = &cobra.Command{
-	Use:     "generate",
+	Use:     "generate [table-glob...]",
 	Aliases: []string{"gen", "g"},
-	Short:   "Generate models from the existing database structure", // TODO: also api crud routes?
+	Short:   "Generate models, repositories, and CRUD routes from the existing database structure",
+	Long: `Generate a model in ./models for each table of the schema (or only those
+matching the given globs, less any excluded) and, for tables with a single
+integer or string primary key, a repository in ./db and gin CRUD handlers in
+./web, mounted under /api/v1 by ApplyGeneratedRoutes. Repositories also get a
+GetBy method for each single column unique key, and for each single column
+foreign key a Load method for the referenced row and a ListBy method for the
+rows referencing it.
+
+Models are named for the singular of their table, e.g. "addresses" becomes
+Address and "people" becomes Person; set "irregulars" in the config for words
+which aren't inflected correctly, or whose model has the name of an enum type.
+Tables which can't be generated, e.g. with columns of an unknown type, are
+skipped with a warning. The migration tables are always skipped.
+
+Tables with a hand-written ./db/<table>.go, like users, keep their own
+repository and handlers. Existing files are only overwritten if they start
+with the generated code header, so remove it from a file to edit it by hand.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		include := append(append([]string{}, args...), optDbGenerateInclude...)
+		for _, pattern := range append(include, optDbGenerateExclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("invalid table glob %q: %v", pattern, err)
+			}
+		}
+		config, err := loadGenerateConfig(optDbGenerateConfig, cmd.Flags().Changed("config"))
+		if err != nil {
+			log.Fatalf("loading generate config: %v", err)
+		}
 		dburl := util.MustEnv(Env_DATABASE_URL)
-		db := must1(db.Connect(dburl))
-		// TODO: cowardly refuse for some reason?
+		dbh := must1(db.Connect(dburl))
+		if dbh.Dialect != db.DialectPostgres {
+			log.Fatalf("model generation requires a postgres database, got %q", dbh.Dialect)
+		}
+		schema := optDbGenerateSchema
+
+		// Generate a string type with constants for each enum.
+		var enumLabels []struct{ Name, Label string }
+		must(dbh.Select(&enumLabels, dbh.Rebind(`SELECT t.typname AS name, e.enumlabel AS label
+			FROM pg_type t
+			JOIN pg_enum e ON e.enumtypid = t.oid
+			JOIN pg_namespace n ON n.oid = t.typnamespace
+			WHERE n.nspname = ?
+			ORDER BY t.typname, e.enumsortorder`), schema))
+		enums := map[string][]string{}
+		for _, el := range enumLabels {
+			enums[el.Name] = append(enums[el.Name], el.Label)
+		}
+		var files []generatedFile
+		if len(enums) > 0 {
+			files = append(files, must1(renderGeneratedFile(filepath.Join(generatedModelsDirname, generatedEnumsBasename+generatedFileSuffix),
+				enumsGoCodeTemplate, newGeneratedEnums(enums))))
+		}
 
-		// Select the public table names.
-		var tableNames []string
-		must(db.Select(&tableNames, `SELECT table_name FROM information_schema.tables WHERE table_schema='public'`))
+		// Select the table names of the schema, except those managed by migrations.
+		var allTableNames []string
+		query := dbh.Rebind(`SELECT table_name FROM information_schema.tables
+			WHERE table_schema = ? AND table_type = 'BASE TABLE'
+			ORDER BY table_name`)
+		must(dbh.Select(&allTableNames, query, schema))
+		tableNames := selectTableNames(allTableNames, include,
+			append([]string{db.MigrationsTablename, db.MigrationsLockTablename, db.IdempotencyKeysTablename}, optDbGenerateExclude...))
+		if len(tableNames) == 0 {
+			log.Printf("WARNING: no tables to generate in schema %q", schema)
+		}
 
-		// Select the column info for each table.
+		// Select the column info and constraints for each table.
+		var tables []generatedTable
+		modelTables := map[string]string{}
 		for _, tableName := range tableNames {
-			var tableInfos []tableInfo
-			query := fmt.Sprintf(`SELECT column_name, data_type, (is_nullable='YES') as nullable FROM information_schema.columns WHERE table_name = '%s' ORDER BY ordinal_position`, tableName)
-			must(db.Select(&tableInfos, query))
-
-			// Generate a Go struct model for each table.
-			filename := fmt.Sprintf("./models/%s.go", filenameFor(tableName))
-			var modelGoCode = bytes.Buffer{}
-			tmpl := must1(template.New("model").Parse(modelGoCodeTemplate))
-			must(tmpl.Execute(&modelGoCode, map[string]any{
-				"Name": strcase.ToCamel(filenameFor(tableName)),
-				"Columns": util.Map(tableInfos, func(ti tableInfo) map[string]any {
-					return map[string]any{
-						"Name":     strcase.ToCamel(ti.Name),
-						"Type":     typeFor(ti.Type),
-						"Nullable": ti.Nullable,
-						"Annotations": "`" + strings.Join(util.Map([]string{"json", "db"}, func(key string) string {
-							return fmt.Sprintf("%s:%q", key, ti.Name)
-						}), " ") + "`",
-					}
-				}),
-			}))
-			// fmt.Println(modelGoCode.String())
-			gocode := must1(format.Source(modelGoCode.Bytes()))
-			must(os.WriteFile(filename, gocode, os.FileMode(0o644)))
-			log.Printf("wrote %q", filename)
+			tableInfos, err := selectTableInfos(dbh, schema, tableName)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			constraints, err := selectTableConstraints(dbh, schema, tableName)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			table, err := newGeneratedTable(config, schema, tableName, tableInfos, constraints, enums)
+			if err != nil {
+				log.Printf("WARNING: skipping %q: %v", tableName, err)
+				continue
+			}
+			if other, ok := modelTables[table.Model]; ok {
+				log.Printf("WARNING: skipping %q whose model %v is already generated for %q, set its singular in the config \"irregulars\"",
+					tableName, table.Model, other)
+				continue
+			}
+			modelTables[table.Model] = tableName
+			tables = append(tables, table)
+		}
+
+		if err := checkEnumTypeNames(enums, modelTables); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		for _, table := range tables {
+			files = append(files, must1(renderGeneratedFile(modelFilename(config, table.Table), modelGoCodeTemplate, table)))
+
+			// Load referenced rows only if their model is generated or hand-written.
+			for _, fk := range table.ForeignKeys {
+				if _, ok := modelTables[fk.RefModel]; ok || fileExists(modelFilename(config, fk.RefTable)) {
+					table.Loaders = append(table.Loaders, fk)
+				} else {
+					log.Printf("skipping Load%v for %q without a model for %q", fk.Name, table.Table, fk.RefTable)
+				}
+			}
+
+			handwritten := filepath.Join(generatedDbDirname, table.Table+".go")
+			switch {
+			case table.Id == nil:
+				log.Printf("skipping repository and routes for %q without a single integer or string primary key", table.Table)
+			case len(table.Update) == 0:
+				log.Printf("skipping repository and routes for %q without writable columns", table.Table)
+			case fileExists(handwritten):
+				log.Printf("skipping repository and routes for %q, see %q", table.Table, handwritten)
+			default:
+				files = append(files,
+					must1(renderGeneratedFile(filepath.Join(generatedDbDirname, table.Table+generatedFileSuffix), repositoryGoCodeTemplate, table)),
+					must1(renderGeneratedFile(filepath.Join(generatedWebDirname, table.Table+generatedFileSuffix), handlersGoCodeTemplate, table)))
+			}
+		}
+
+		// Mount the routes of every generated handler file, including
+		// those from previous runs for other tables.
+		files = append(files, must1(renderGeneratedFile(filepath.Join(generatedWebDirname, generatedRoutesBasename+generatedFileSuffix),
+			routesGoCodeTemplate, generatedHandlerNames(files))))
+
+		changed := must1(applyGeneratedFiles(files, optDbGenerateDryRun, optDbGenerateCheck))
+		switch {
+		case optDbGenerateDryRun:
+			log.Printf("dry-run: %v generated file(s) would change", len(changed))
+		case optDbGenerateCheck && len(changed) > 0:
+			log.Fatalf("%v generated file(s) out of date with the database schema, run \"webapp db generate\"", len(changed))
+		case optDbGenerateCheck:
+			log.Printf("all generated files are up to date")
 		}
 	},
 }
 
-type tableInfo struct {
-	Name     string `db:"column_name"`
-	Type     string `db:"data_type"`
-	Nullable bool   `db:"nullable"`
+// Fail when an enum type has the name of a generated model, e.g. enum
+// "status" and table "statuses", since the models package wouldn't compile.
+func checkEnumTypeNames(enums map[string][]string, modelTables map[string]string) error {
+	enumNames := make([]string, 0, len(enums))
+	for name := range enums {
+		enumNames = append(enumNames, name)
+	}
+	sort.Strings(enumNames)
+	for _, name := range enumNames {
+		if table, ok := modelTables[enumTypeFor(name)]; ok {
+			return fmt.Errorf("enum %q and the model of table %q are both named %v, rename the enum or set the table's singular in the config \"irregulars\"",
+				name, table, enumTypeFor(name))
+		}
+	}
+	return nil
+}
+
+// The table names matching any include glob (or all if none) and no exclude
+// glob, warning about include globs which match nothing.
+func selectTableNames(tableNames, include, exclude []string) []string {
+	matches := func(pattern, tableName string) bool {
+		ok, _ := path.Match(pattern, tableName)
+		return ok
+	}
+	var selected []string
+	matched := map[string]bool{}
+	for _, tableName := range tableNames {
+		included := len(include) == 0
+		for _, pattern := range include {
+			if matches(pattern, tableName) {
+				included, matched[pattern] = true, true
+			}
+		}
+		for _, pattern := range exclude {
+			included = included && !matches(pattern, tableName)
+		}
+		if included {
+			selected = append(selected, tableName)
+		}
+	}
+	for _, pattern := range include {
+		if !matched[pattern] {
+			log.Printf("WARNING: no tables match %q", pattern)
+		}
+	}
+	return selected
+}
+
+// The template data for a table's model, repository, and handlers.
+type generatedTable struct {
+	Table    string // e.g. "blog_posts"
+	SQLTable string // e.g. "blog.blog_posts" outside of the default schema
+	Model    string // e.g. "BlogPost"
+	Plural   string // e.g. "BlogPosts"
+	Var      string // e.g. "blogPost"
+
+	PluralVar string // e.g. "blogPosts"
+
+	Columns     []generatedColumn
+	Id          *generatedColumn  // The single column integer or string primary key.
+	Insert      []generatedColumn // Not defaulted keys or timestamps.
+	Update      []generatedColumn // Not keys or timestamps.
+	UpdatedAt   bool
+	Uniques     []generatedColumn // Single column unique keys other than the primary key.
+	ForeignKeys []generatedForeignKey
+	Loaders     []generatedForeignKey // Foreign keys to tables with a model.
+	Constraints []string              // Descriptions for the model doc comment.
+}
+
+type generatedColumn struct {
+	Name        string // The Go field name.
+	Var         string // The Go variable name.
+	Column      string
+	Type        string
+	Import      string
+	Annotations string
 }
 
-func typeFor(postgresType string) string {
-	switch postgresType {
-	case "integer":
-		return "int"
-	case "text":
-		return "string"
+// The Go type of a column with any pointer for NULL removed.
+func (c generatedColumn) BaseType() string {
+	return strings.TrimPrefix(c.Type, "*")
+}
+
+// A single column foreign key to a table with a model.
+type generatedForeignKey struct {
+	Name        string // e.g. "Author" for "author_id"
+	Column      generatedColumn
+	RefTable    string
+	RefSQLTable string
+	RefColumn   string
+	RefModel    string
+	RefColumns  string
+}
+
+// Integer and string primary keys can be parsed from route parameters.
+var generatedIdTypes = map[string]bool{"int": true, "int16": true, "int32": true, "int64": true, "string": true}
+
+func newGeneratedTable(config generateConfig, schema, tableName string, tableInfos []tableInfo, constraints tableConstraints, enums map[string][]string) (generatedTable, error) {
+	model := strcase.ToCamel(config.singular(tableName))
+	table := generatedTable{
+		Table:    tableName,
+		SQLTable: qualifiedTableName(schema, tableName),
+		Model:    model,
+		Plural:   strcase.ToCamel(tableName),
+		Var:      varFor(model),
+
+		PluralVar: varFor(strcase.ToCamel(tableName)),
+	}
+	isPrimaryKey := map[string]bool{}
+	for _, name := range constraints.PrimaryKey {
+		isPrimaryKey[name] = true
+	}
+	columns := map[string]generatedColumn{}
+	for _, ti := range tableInfos {
+		t, err := typeFor(config, tableName, ti, enums)
+		if err != nil {
+			return table, err
+		}
+		column := generatedColumn{
+			Name:   strcase.ToCamel(ti.Name),
+			Var:    varFor(strcase.ToCamel(ti.Name)),
+			Column: ti.Name,
+			Type:   t.Type,
+			Import: t.Import,
+			Annotations: "`" + strings.Join(util.Map([]string{"json", "db"}, func(key string) string {
+				return fmt.Sprintf("%s:%q", key, ti.Name)
+			}), " ") + "`",
+		}
+		columns[ti.Name] = column
+		table.Columns = append(table.Columns, column)
+		switch {
+		case ti.Name == "created_at":
+		case ti.Name == "updated_at":
+			table.UpdatedAt = true
+		case isPrimaryKey[ti.Name]:
+			if !ti.HasDefault {
+				table.Insert = append(table.Insert, column)
+			}
+		default:
+			table.Insert = append(table.Insert, column)
+			table.Update = append(table.Update, column)
+		}
 	}
 
-	if strings.HasPrefix(postgresType, "time") {
-		return "*time.Time"
+	if len(constraints.PrimaryKey) > 0 {
+		table.Constraints = append(table.Constraints, "Primary key: "+strings.Join(constraints.PrimaryKey, ", ")+".")
+	}
+	if len(constraints.PrimaryKey) == 1 {
+		if column := columns[constraints.PrimaryKey[0]]; generatedIdTypes[column.Type] {
+			table.Id = &column
+		}
 	}
+	for _, unique := range constraints.Uniques {
+		table.Constraints = append(table.Constraints, "Unique: "+strings.Join(unique, ", ")+".")
+		if len(unique) == 1 {
+			table.Uniques = append(table.Uniques, columns[unique[0]])
+		}
+	}
+	for _, fk := range constraints.ForeignKeys {
+		table.Constraints = append(table.Constraints, fmt.Sprintf("Foreign key: %v references %v(%v).",
+			strings.Join(fk.Columns, ", "), fk.RefTable, strings.Join(fk.RefColumns, ", ")))
+		if len(fk.Columns) == 1 {
+			table.ForeignKeys = append(table.ForeignKeys, generatedForeignKey{
+				Name:        strcase.ToCamel(strings.TrimSuffix(fk.Columns[0], "_id")),
+				Column:      columns[fk.Columns[0]],
+				RefTable:    fk.RefTable,
+				RefSQLTable: qualifiedTableName(fk.RefSchema, fk.RefTable),
+				RefColumn:   fk.RefColumns[0],
+				RefModel:    strcase.ToCamel(config.singular(fk.RefTable)),
+				RefColumns:  strings.Join(fk.RefTableColumns, ", "),
+			})
+		}
+	}
+	return table, nil
+}
 
-	panic(fmt.Errorf("unhandled postgres type %q", postgresType))
+// The import declaration of a model, standard library packages first.
+func (t generatedTable) Imports() string {
+	seen := map[string]bool{}
+	var std, other []string
+	for _, column := range t.Columns {
+		if column.Import == "" || seen[column.Import] {
+			continue
+		}
+		seen[column.Import] = true
+		if strings.Contains(strings.Split(column.Import, "/")[0], ".") {
+			other = append(other, fmt.Sprintf("%q", column.Import))
+		} else {
+			std = append(std, fmt.Sprintf("%q", column.Import))
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	switch len(std) + len(other) {
+	case 0:
+		return ""
+	case 1:
+		return "import " + strings.Join(append(std, other...), "")
+	}
+	groups := util.Map([][]string{std, other}, func(group []string) string { return strings.Join(group, "\n") })
+	return "import (\n" + strings.TrimSpace(strings.Join(groups, "\n\n")) + "\n)"
+}
+
+type generatedEnum struct {
+	Type   string
+	Labels []generatedEnumLabel
+}
+
+type generatedEnumLabel struct {
+	Const, Label string
 }
 
-const modelGoCodeTemplate = `package models
+func newGeneratedEnums(enums map[string][]string) []generatedEnum {
+	var generated []generatedEnum
+	for name, labels := range enums {
+		enum := generatedEnum{Type: enumTypeFor(name)}
+		for _, label := range labels {
+			enum.Labels = append(enum.Labels, generatedEnumLabel{enum.Type + strcase.ToCamel(label), label})
+		}
+		generated = append(generated, enum)
+	}
+	sort.Slice(generated, func(i, j int) bool { return generated[i].Type < generated[j].Type })
+	return generated
+}
 
-import "time"
+// The handler files from this and previous runs, by table name.
+func generatedHandlerNames(files []generatedFile) []string {
+	filenames := must1(filepath.Glob(filepath.Join(generatedWebDirname, "*"+generatedFileSuffix)))
+	for _, file := range files {
+		filenames = append(filenames, file.Filename)
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, filename := range filenames {
+		if filepath.Dir(filename) != filepath.Clean(generatedWebDirname) || !strings.HasSuffix(filename, generatedFileSuffix) {
+			continue
+		}
+		tableName := strings.TrimSuffix(filepath.Base(filename), generatedFileSuffix)
+		if tableName != generatedRoutesBasename && !seen[tableName] {
+			seen[tableName] = true
+			names = append(names, strcase.ToCamel(tableName))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
 
-type {{ .Name }} struct { {{- range .Columns }}
-	{{ .Name }} {{if .Nullable}}*{{end}}{{ .Type }} {{ .Annotations }}{{end}}
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
 }
-`
 
-func filenameFor(s string) string {
-	if strings.HasSuffix(s, "ies") {
-		return s[:len(s)-3] + "y"
-	} else if strings.HasSuffix(s, "s") {
-		return s[:len(s)-1]
+// A local variable name for a model which won't clash with the other
+// identifiers in the generated code.
+func varFor(model string) string {
+	name := strcase.ToLowerCamel(model)
+	if token.IsKeyword(name) {
+		return name + "Record"
+	}
+	for _, ident := range generatedIdentifiers {
+		if ident == name {
+			return name + "Record"
+		}
 	}
-	panic(fmt.Errorf("unhandled table singularlization %q", s))
+	return name
+}
+
+// The model file of a table, e.g. "./models/blog_post.go".
+func modelFilename(config generateConfig, tableName string) string {
+	return filepath.Join(generatedModelsDirname, config.singular(tableName)+".go")
 }
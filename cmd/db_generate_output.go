@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+
+	log "github.com/maerics/golog"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Marks files which the generator may overwrite, see https://go.dev/s/generatedcode.
+const generatedCodeHeader = `// Code generated by "webapp db generate"; DO NOT EDIT.`
+
+var generatedCodeRegex = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+
+type generatedFile struct {
+	Filename string
+	Code     []byte
+}
+
+// Render a code template and format it, failing on invalid Go code.
+func renderGeneratedFile(filename, codeTemplate string, data any) (generatedFile, error) {
+	code := bytes.NewBufferString(generatedCodeHeader + "\n\n")
+	tmpl, err := template.New(filepath.Base(filename)).Funcs(generateTemplateFuncs).Parse(codeTemplate)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	if err := tmpl.Execute(code, data); err != nil {
+		return generatedFile{}, err
+	}
+	gocode, err := format.Source(code.Bytes())
+	if err != nil {
+		return generatedFile{}, fmt.Errorf("formatting %q: %w\n%v", filename, err, code.String())
+	}
+	return generatedFile{filename, gocode}, nil
+}
+
+// Write the files which changed, or for a dry-run print their diffs, or for
+// a check only list them, returning their names. Existing files without the
+// generated code header are never touched.
+func applyGeneratedFiles(files []generatedFile, dryRun, check bool) ([]string, error) {
+	var changed []string
+	for _, file := range files {
+		existing, err := os.ReadFile(file.Filename)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return changed, fmt.Errorf("reading %q: %w", file.Filename, err)
+		}
+		if exists && bytes.Equal(existing, file.Code) {
+			log.Debugf("%q is up to date", file.Filename)
+			continue
+		}
+		if exists && !generatedCodeRegex.Match(existing) {
+			log.Printf("WARNING: refusing to overwrite %q which has no generated code header", file.Filename)
+			continue
+		}
+
+		changed = append(changed, file.Filename)
+		switch {
+		case dryRun:
+			if err := printUnifiedDiff(file.Filename, exists, existing, file.Code); err != nil {
+				return changed, err
+			}
+		case check:
+			log.Printf("%q is out of date", file.Filename)
+		default:
+			if err := os.WriteFile(file.Filename, file.Code, os.FileMode(0o644)); err != nil {
+				return changed, err
+			}
+			log.Printf("wrote %q", file.Filename)
+		}
+	}
+	return changed, nil
+}
+
+func printUnifiedDiff(filename string, exists bool, existing, code []byte) error {
+	fromFile := "a/" + filepath.ToSlash(filepath.Clean(filename))
+	if !exists {
+		fromFile = "/dev/null"
+	}
+	var lines []string
+	if exists {
+		lines = difflib.SplitLines(string(existing))
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        lines,
+		B:        difflib.SplitLines(string(code)),
+		FromFile: fromFile,
+		ToFile:   "b/" + filepath.ToSlash(filepath.Clean(filename)),
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Print(diff)
+	return err
+}
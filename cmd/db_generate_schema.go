@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"webapp/db"
+)
+
+type tableInfo struct {
+	Name       string `db:"column_name"`
+	Type       string `db:"data_type"`
+	UdtName    string `db:"udt_name"`
+	Nullable   bool   `db:"nullable"`
+	HasDefault bool   `db:"has_default"` // Including serial and identity columns.
+}
+
+func selectTableInfos(dbh *db.DB, schema, tableName string) ([]tableInfo, error) {
+	var tableInfos []tableInfo
+	query := dbh.Rebind(`SELECT column_name, data_type, udt_name,
+			(is_nullable = 'YES') AS nullable,
+			(column_default IS NOT NULL OR is_identity = 'YES') AS has_default
+		FROM information_schema.columns
+		WHERE table_schema = ? AND table_name = ?
+		ORDER BY ordinal_position`)
+	if err := dbh.Select(&tableInfos, query, schema, tableName); err != nil {
+		return nil, err
+	}
+	if len(tableInfos) == 0 {
+		return nil, fmt.Errorf("table %q not found in schema %q", tableName, schema)
+	}
+	return tableInfos, nil
+}
+
+// The primary key, unique, and foreign key constraints of a table, by
+// column name in constraint order.
+type tableConstraints struct {
+	PrimaryKey  []string
+	Uniques     [][]string
+	ForeignKeys []foreignKeyInfo
+}
+
+type foreignKeyInfo struct {
+	Columns    []string
+	RefSchema  string
+	RefTable   string
+	RefColumns []string
+
+	// Every column of the referenced table, for single column foreign keys.
+	RefTableColumns []string
+}
+
+func selectTableConstraints(dbh *db.DB, schema, tableName string) (tableConstraints, error) {
+	var constraints tableConstraints
+
+	var keys []struct{ Name, Type, ColumnName string }
+	query := dbh.Rebind(`SELECT tc.constraint_name AS name, tc.constraint_type AS type, kcu.column_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+		  ON kcu.constraint_schema = tc.constraint_schema AND kcu.constraint_name = tc.constraint_name
+		 AND kcu.table_name = tc.table_name
+		WHERE tc.table_schema = ? AND tc.table_name = ? AND tc.constraint_type IN ('PRIMARY KEY', 'UNIQUE')
+		ORDER BY tc.constraint_type, tc.constraint_name, kcu.ordinal_position`)
+	if err := dbh.Select(&keys, query, schema, tableName); err != nil {
+		return constraints, err
+	}
+	for i, key := range keys {
+		switch {
+		case key.Type == "PRIMARY KEY":
+			constraints.PrimaryKey = append(constraints.PrimaryKey, key.ColumnName)
+		case i > 0 && keys[i-1].Name == key.Name:
+			last := len(constraints.Uniques) - 1
+			constraints.Uniques[last] = append(constraints.Uniques[last], key.ColumnName)
+		default:
+			constraints.Uniques = append(constraints.Uniques, []string{key.ColumnName})
+		}
+	}
+
+	var refs []struct{ Name, ColumnName, RefSchema, RefTable, RefColumn string }
+	query = dbh.Rebind(`SELECT kcu.constraint_name AS name, kcu.column_name,
+			ref.table_schema AS ref_schema, ref.table_name AS ref_table, ref.column_name AS ref_column
+		FROM information_schema.referential_constraints rc
+		JOIN information_schema.key_column_usage kcu
+		  ON kcu.constraint_schema = rc.constraint_schema AND kcu.constraint_name = rc.constraint_name
+		JOIN information_schema.key_column_usage ref
+		  ON ref.constraint_schema = rc.unique_constraint_schema AND ref.constraint_name = rc.unique_constraint_name
+		 AND ref.ordinal_position = kcu.position_in_unique_constraint
+		WHERE kcu.table_schema = ? AND kcu.table_name = ?
+		ORDER BY kcu.constraint_name, kcu.ordinal_position`)
+	if err := dbh.Select(&refs, query, schema, tableName); err != nil {
+		return constraints, err
+	}
+	for i, ref := range refs {
+		if i > 0 && refs[i-1].Name == ref.Name {
+			fk := &constraints.ForeignKeys[len(constraints.ForeignKeys)-1]
+			fk.Columns = append(fk.Columns, ref.ColumnName)
+			fk.RefColumns = append(fk.RefColumns, ref.RefColumn)
+			continue
+		}
+		constraints.ForeignKeys = append(constraints.ForeignKeys, foreignKeyInfo{
+			Columns:    []string{ref.ColumnName},
+			RefSchema:  ref.RefSchema,
+			RefTable:   ref.RefTable,
+			RefColumns: []string{ref.RefColumn},
+		})
+	}
+	for i, fk := range constraints.ForeignKeys {
+		if len(fk.Columns) != 1 {
+			continue
+		}
+		refTableInfos, err := selectTableInfos(dbh, fk.RefSchema, fk.RefTable)
+		if err != nil {
+			return constraints, err
+		}
+		for _, ti := range refTableInfos {
+			constraints.ForeignKeys[i].RefTableColumns = append(constraints.ForeignKeys[i].RefTableColumns, ti.Name)
+		}
+	}
+	return constraints, nil
+}
+
+// A table name for generated SQL, qualified outside of the default schema.
+func qualifiedTableName(schema, tableName string) string {
+	if schema == defaultGenerateSchema {
+		return tableName
+	}
+	return schema + "." + tableName
+}
@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	util "github.com/maerics/goutil"
+)
+
+// Identifiers used by the generated code which model variables must avoid.
+var generatedIdentifiers = []string{
+	"c", "ctx", "db", "err", "id", "parsed", "query", "r", "ref", "repo", "rg", "s", "created", "updated",
+}
+
+var generateTemplateFuncs = template.FuncMap{
+	"columns": func(columns []generatedColumn) string {
+		return strings.Join(util.Map(columns, func(c generatedColumn) string { return c.Column }), ", ")
+	},
+	"placeholders": func(columns []generatedColumn) string {
+		return strings.Join(util.Map(columns, func(generatedColumn) string { return "?" }), ", ")
+	},
+	"assignments": func(columns []generatedColumn) string {
+		return strings.Join(util.Map(columns, func(c generatedColumn) string { return c.Column + " = ?" }), ", ")
+	},
+	"parseId": func(id generatedColumn) string {
+		switch id.Type {
+		case "string":
+			return `id := c.Param("id")`
+		case "int":
+			return "id, err := strconv.Atoi(c.Param(\"id\"))\nwebMust(c, 404, err)"
+		case "int64":
+			return "id, err := strconv.ParseInt(c.Param(\"id\"), 10, 64)\nwebMust(c, 404, err)"
+		}
+		bits := strings.TrimPrefix(id.Type, "int")
+		return fmt.Sprintf("parsed, err := strconv.ParseInt(c.Param(\"id\"), 10, %v)\nwebMust(c, 404, err)\nid := %v(parsed)", bits, id.Type)
+	},
+}
+
+const modelGoCodeTemplate = `package models
+
+{{ .Imports }}
+
+// A row of the "{{ .Table }}" table.{{ with .Constraints }}
+//{{ range . }}
+//   - {{ . }}{{ end }}{{ end }}
+type {{ .Model }} struct { {{- range .Columns }}
+	{{ .Name }} {{ .Type }} {{ .Annotations }}{{end}}
+}
+`
+
+const enumsGoCodeTemplate = `package models
+{{ range . }}{{ $type := .Type }}
+type {{ $type }} string
+
+const ({{ range .Labels }}
+	{{ .Const }} {{ $type }} = {{ printf "%q" .Label }}{{ end }}
+)
+{{ end }}`
+
+const repositoryGoCodeTemplate = `package db
+
+import (
+	"context"
+	"database/sql"{{ if .UpdatedAt }}
+	"time"{{ end }}
+	"webapp/models"
+)
+
+// Storage for {{ .Table }}. Lookups of missing rows return sql.ErrNoRows.
+type {{ .Model }}Repository interface {
+	Create(ctx context.Context, {{ .Var }} models.{{ .Model }}) (models.{{ .Model }}, error)
+	Get(ctx context.Context, id {{ .Id.Type }}) (models.{{ .Model }}, error){{ range .Uniques }}
+	GetBy{{ .Name }}(ctx context.Context, {{ .Var }} {{ .BaseType }}) (models.{{ $.Model }}, error){{ end }}
+	List(ctx context.Context) ([]models.{{ .Model }}, error){{ range .ForeignKeys }}
+	ListBy{{ .Column.Name }}(ctx context.Context, {{ .Column.Var }} {{ .Column.BaseType }}) ([]models.{{ $.Model }}, error){{ end }}
+	Update(ctx context.Context, {{ .Var }} models.{{ .Model }}) (models.{{ .Model }}, error)
+	Delete(ctx context.Context, id {{ .Id.Type }}) error{{ range .Loaders }}
+	Load{{ .Name }}(ctx context.Context, {{ $.Var }} models.{{ $.Model }}) (models.{{ .RefModel }}, error){{ end }}
+}
+
+const {{ .Var }}Columns = "{{ columns .Columns }}"
+
+type sql{{ .Model }}Repository struct {
+	db *DB
+}
+
+// Store {{ .Table }} in the "{{ .Table }}" table, reading from the read replica.
+func New{{ .Model }}Repository(db *DB) {{ .Model }}Repository {
+	return &sql{{ .Model }}Repository{db}
+}
+
+func (r *sql{{ .Model }}Repository) Create(ctx context.Context, {{ .Var }} models.{{ .Model }}) (models.{{ .Model }}, error) {
+	var created models.{{ .Model }}
+	query := r.db.Rebind("INSERT INTO {{ .SQLTable }} {{ with .Insert }}({{ columns . }}) VALUES ({{ placeholders . }}){{ else }}DEFAULT VALUES{{ end }} RETURNING " + {{ .Var }}Columns)
+	err := r.db.GetContext(ctx, &created, query{{ range .Insert }}, {{ $.Var }}.{{ .Name }}{{ end }})
+	return created, err
+}
+
+func (r *sql{{ .Model }}Repository) Get(ctx context.Context, id {{ .Id.Type }}) (models.{{ .Model }}, error) {
+	var {{ .Var }} models.{{ .Model }}
+	query := r.db.Rebind("SELECT " + {{ .Var }}Columns + " FROM {{ .SQLTable }} WHERE {{ .Id.Column }} = ?")
+	err := r.db.Reader().GetContext(ctx, &{{ .Var }}, query, id)
+	return {{ .Var }}, err
+}
+{{ range .Uniques }}
+func (r *sql{{ $.Model }}Repository) GetBy{{ .Name }}(ctx context.Context, {{ .Var }} {{ .BaseType }}) (models.{{ $.Model }}, error) {
+	var {{ $.Var }} models.{{ $.Model }}
+	query := r.db.Rebind("SELECT " + {{ $.Var }}Columns + " FROM {{ $.SQLTable }} WHERE {{ .Column }} = ?")
+	err := r.db.Reader().GetContext(ctx, &{{ $.Var }}, query, {{ .Var }})
+	return {{ $.Var }}, err
+}
+{{ end }}
+func (r *sql{{ .Model }}Repository) List(ctx context.Context) ([]models.{{ .Model }}, error) {
+	{{ .PluralVar }} := []models.{{ .Model }}{}
+	query := "SELECT " + {{ .Var }}Columns + " FROM {{ .SQLTable }} ORDER BY {{ .Id.Column }}"
+	err := r.db.Reader().SelectContext(ctx, &{{ .PluralVar }}, query)
+	return {{ .PluralVar }}, err
+}
+{{ range .ForeignKeys }}
+// List the {{ $.Table }} referencing a {{ .RefTable }} row by {{ .Column.Column }}.
+func (r *sql{{ $.Model }}Repository) ListBy{{ .Column.Name }}(ctx context.Context, {{ .Column.Var }} {{ .Column.BaseType }}) ([]models.{{ $.Model }}, error) {
+	{{ $.PluralVar }} := []models.{{ $.Model }}{}
+	query := r.db.Rebind("SELECT " + {{ $.Var }}Columns + " FROM {{ $.SQLTable }} WHERE {{ .Column.Column }} = ? ORDER BY {{ $.Id.Column }}")
+	err := r.db.Reader().SelectContext(ctx, &{{ $.PluralVar }}, query, {{ .Column.Var }})
+	return {{ $.PluralVar }}, err
+}
+{{ end }}
+func (r *sql{{ .Model }}Repository) Update(ctx context.Context, {{ .Var }} models.{{ .Model }}) (models.{{ .Model }}, error) {
+	var updated models.{{ .Model }}
+	query := r.db.Rebind("UPDATE {{ .SQLTable }} SET {{ assignments .Update }}{{ if .UpdatedAt }}, updated_at = ?{{ end }} WHERE {{ .Id.Column }} = ? RETURNING " + {{ .Var }}Columns)
+	err := r.db.GetContext(ctx, &updated, query{{ range .Update }}, {{ $.Var }}.{{ .Name }}{{ end }}{{ if .UpdatedAt }}, r.db.TimeArg(time.Now()){{ end }}, {{ .Var }}.{{ .Id.Name }})
+	return updated, err
+}
+
+func (r *sql{{ .Model }}Repository) Delete(ctx context.Context, id {{ .Id.Type }}) error {
+	result, err := r.db.ExecContext(ctx, r.db.Rebind("DELETE FROM {{ .SQLTable }} WHERE {{ .Id.Column }} = ?"), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+{{ range .Loaders }}
+// Load the {{ .RefTable }} row referenced by {{ .Column.Column }}, sql.ErrNoRows if NULL.
+func (r *sql{{ $.Model }}Repository) Load{{ .Name }}(ctx context.Context, {{ $.Var }} models.{{ $.Model }}) (models.{{ .RefModel }}, error) {
+	var ref models.{{ .RefModel }}
+	query := r.db.Rebind("SELECT {{ .RefColumns }} FROM {{ .RefSQLTable }} WHERE {{ .RefColumn }} = ?")
+	err := r.db.Reader().GetContext(ctx, &ref, query, {{ $.Var }}.{{ .Column.Name }})
+	return ref, err
+}
+{{ end }}`
+
+const handlersGoCodeTemplate = `package web
+
+import (
+	"database/sql"
+	"errors"{{ if ne .Id.Type "string" }}
+	"strconv"{{ end }}
+	"webapp/db"
+	"webapp/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Mount the {{ .Table }} CRUD routes, see ApplyGeneratedRoutes and the
+// OpenAPI document.
+func (s *Server) Apply{{ .Plural }}Routes(rg gin.IRoutes) {
+	repo := db.New{{ .Model }}Repository(s.DB)
+	rg.GET("/{{ .Table }}", s.List{{ .Plural }}(repo))
+	rg.PUT("/{{ .Table }}", s.Create{{ .Model }}(repo))
+	rg.GET("/{{ .Table }}/:id", s.Get{{ .Model }}(repo))
+	rg.POST("/{{ .Table }}/:id", s.Update{{ .Model }}(repo))
+	rg.DELETE("/{{ .Table }}/:id", s.Delete{{ .Model }}(repo))
+}
+
+func init() {
+	apiV1Operations["GET /{{ .Table }}"] = apiOperation{
+		OperationId: "list{{ .Plural }}",
+		Summary:     "List {{ .Table }}",
+		Response:    []models.{{ .Model }}{},
+	}
+	apiV1Operations["PUT /{{ .Table }}"] = apiOperation{
+		OperationId: "create{{ .Model }}",
+		Summary:     "Create a row in {{ .Table }}",
+		Request:     models.{{ .Model }}{},
+		Response:    models.{{ .Model }}{},
+	}
+	apiV1Operations["GET /{{ .Table }}/:id"] = apiOperation{
+		OperationId: "get{{ .Model }}",
+		Summary:     "Get a row of {{ .Table }}",
+		Params:      map[string]any{"id": *new({{ .Id.Type }})},
+		Response:    models.{{ .Model }}{},
+	}
+	apiV1Operations["POST /{{ .Table }}/:id"] = apiOperation{
+		OperationId: "update{{ .Model }}",
+		Summary:     "Update a row of {{ .Table }}",
+		Params:      map[string]any{"id": *new({{ .Id.Type }})},
+		Request:     models.{{ .Model }}{},
+		Response:    models.{{ .Model }}{},
+	}
+	apiV1Operations["DELETE /{{ .Table }}/:id"] = apiOperation{
+		OperationId: "delete{{ .Model }}",
+		Summary:     "Delete a row of {{ .Table }}",
+		Params:      map[string]any{"id": *new({{ .Id.Type }})},
+		Status:      204,
+	}
+}
+
+func (s *Server) List{{ .Plural }}(repo db.{{ .Model }}Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		{{ .PluralVar }}, err := repo.List(c.Request.Context())
+		webMust(c, 500, err)
+		renderJSON(c, 200, {{ .PluralVar }})
+	}
+}
+
+func (s *Server) Create{{ .Model }}(repo db.{{ .Model }}Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var {{ .Var }} models.{{ .Model }}
+		webMust(c, 400, c.BindJSON(&{{ .Var }}))
+
+		created, err := repo.Create(c.Request.Context(), {{ .Var }})
+		s.mustWriteRow(c, err)
+		renderJSON(c, 200, created)
+	}
+}
+
+func (s *Server) Get{{ .Model }}(repo db.{{ .Model }}Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		{{ parseId .Id }}
+
+		{{ .Var }}, err := repo.Get(c.Request.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.notFound(c)
+		}
+		webMust(c, 500, err)
+		renderJSON(c, 200, {{ .Var }})
+	}
+}
+
+func (s *Server) Update{{ .Model }}(repo db.{{ .Model }}Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		{{ parseId .Id }}
+
+		var {{ .Var }} models.{{ .Model }}
+		webMust(c, 400, c.BindJSON(&{{ .Var }}))
+		{{ .Var }}.{{ .Id.Name }} = id
+
+		updated, err := repo.Update(c.Request.Context(), {{ .Var }})
+		s.mustWriteRow(c, err)
+		renderJSON(c, 200, updated)
+	}
+}
+
+func (s *Server) Delete{{ .Model }}(repo db.{{ .Model }}Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		{{ parseId .Id }}
+
+		s.mustWriteRow(c, repo.Delete(c.Request.Context(), id))
+		c.Status(204)
+	}
+}
+`
+
+const routesGoCodeTemplate = `package web
+
+import "github.com/gin-gonic/gin"
+
+// Mount the CRUD routes of every table generated by "webapp db generate".
+func (s *Server) ApplyGeneratedRoutes(rg gin.IRoutes) { {{- range . }}
+	s.Apply{{ . }}Routes(rg){{ end }}
+}
+`
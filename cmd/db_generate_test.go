@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeFor(t *testing.T) {
+	config := generateConfig{
+		Types:   map[string]goType{"numeric": {Type: "decimal.Decimal", Import: "github.com/shopspring/decimal"}},
+		Columns: map[string]goType{"posts.price": {Type: "int64"}},
+	}
+	enums := map[string][]string{"post_status": {"draft", "published"}}
+	for _, eg := range []struct {
+		column   tableInfo
+		expected goType
+	}{
+		{tableInfo{Name: "id", UdtName: "int4"}, goType{Type: "int"}},
+		{tableInfo{Name: "views", UdtName: "int8", Nullable: true}, goType{Type: "*int64"}},
+		{tableInfo{Name: "title", UdtName: "text"}, goType{Type: "string"}},
+		{tableInfo{Name: "summary", UdtName: "varchar", Nullable: true}, goType{Type: "*string"}},
+		{tableInfo{Name: "body", UdtName: "bytea", Nullable: true}, goType{Type: "[]byte", nilable: true}},
+		{tableInfo{Name: "meta", UdtName: "jsonb", Nullable: true}, goType{Type: "json.RawMessage", Import: "encoding/json", nilable: true}},
+		{tableInfo{Name: "published_at", UdtName: "timestamptz", Nullable: true}, goType{Type: "*time.Time", Import: "time", nilable: true}},
+		{tableInfo{Name: "tags", UdtName: "_text"}, goType{Type: "StringArray", nilable: true}},
+		{tableInfo{Name: "status", UdtName: "post_status"}, goType{Type: "PostStatus"}},
+		{tableInfo{Name: "prior_status", UdtName: "post_status", Nullable: true}, goType{Type: "*PostStatus"}},
+		{tableInfo{Name: "statuses", UdtName: "_post_status"}, goType{Type: "StringArray", nilable: true}},
+		{tableInfo{Name: "rating", UdtName: "numeric", Nullable: true}, goType{Type: "decimal.Decimal", Import: "github.com/shopspring/decimal"}},
+		{tableInfo{Name: "price", UdtName: "numeric"}, goType{Type: "int64"}},
+	} {
+		actual, err := typeFor(config, "posts", eg.column, enums)
+		assert.NoError(t, err, eg.column.Name)
+		assert.Equal(t, eg.expected, actual, eg.column.Name)
+	}
+
+	_, err := typeFor(config, "posts", tableInfo{Name: "area", UdtName: "geometry"}, enums)
+	assert.ErrorContains(t, err, `unhandled postgres type "geometry"`)
+}
+
+func TestCheckEnumTypeNames(t *testing.T) {
+	enums := map[string][]string{"status": {"draft", "published"}, "post_kind": {"note"}}
+	assert.NoError(t, checkEnumTypeNames(enums, map[string]string{"Post": "posts"}))
+	err := checkEnumTypeNames(enums, map[string]string{"Post": "posts", "Status": "statuses"})
+	assert.ErrorContains(t, err, `enum "status" and the model of table "statuses" are both named Status`)
+}
+
+func TestApplyGeneratedFiles(t *testing.T) {
+	dir := t.TempDir()
+	generated := []byte(generatedCodeHeader + "\n\npackage models\n")
+	handwritten := []byte("package models\n\n// Edited by hand.\n")
+	files := map[string][]byte{
+		"new.go":         nil,
+		"generated.go":   []byte(generatedCodeHeader + "\n\npackage models // Out of date.\n"),
+		"handwritten.go": handwritten,
+		"uptodate.go":    generated,
+	}
+	var generatedFiles []generatedFile
+	for name, code := range files {
+		filename := filepath.Join(dir, name)
+		if code != nil {
+			tmust(t, os.WriteFile(filename, code, 0o644))
+		}
+		generatedFiles = append(generatedFiles, generatedFile{filename, generated})
+	}
+	read := func(name string) string {
+		bs, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		tmust(t, err)
+		return string(bs)
+	}
+	expectChanged := []string{filepath.Join(dir, "generated.go"), filepath.Join(dir, "new.go")}
+
+	for _, mode := range []struct {
+		name          string
+		dryRun, check bool
+	}{{"dry-run", true, false}, {"check", false, true}} {
+		changed, err := applyGeneratedFiles(generatedFiles, mode.dryRun, mode.check)
+		assert.NoError(t, err, mode.name)
+		assert.ElementsMatch(t, expectChanged, changed, mode.name)
+		assert.Equal(t, "", read("new.go"), mode.name)
+		assert.True(t, strings.HasSuffix(read("generated.go"), "// Out of date.\n"), mode.name)
+	}
+
+	changed, err := applyGeneratedFiles(generatedFiles, false, false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expectChanged, changed)
+	assert.Equal(t, string(generated), read("new.go"))
+	assert.Equal(t, string(generated), read("generated.go"))
+	assert.Equal(t, string(handwritten), read("handwritten.go"), "files without the header are never overwritten")
+
+	changed, err = applyGeneratedFiles(generatedFiles, false, true)
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+}
+
+// Every template renders Go code which formats, for a table using most
+// features of the generator.
+func TestRenderGeneratedFiles(t *testing.T) {
+	config := generateConfig{inflector: newInflector(nil)}
+	enums := map[string][]string{"post_status": {"draft", "published"}}
+	table, err := newGeneratedTable(config, "blog", "blog_posts", []tableInfo{
+		{Name: "id", UdtName: "int8", HasDefault: true},
+		{Name: "author_id", UdtName: "int4"},
+		{Name: "slug", UdtName: "text"},
+		{Name: "title", UdtName: "varchar", Nullable: true},
+		{Name: "status", UdtName: "post_status"},
+		{Name: "tags", UdtName: "_text"},
+		{Name: "meta", UdtName: "jsonb", Nullable: true},
+		{Name: "created_at", UdtName: "timestamp", HasDefault: true},
+		{Name: "updated_at", UdtName: "timestamp", HasDefault: true},
+	}, tableConstraints{
+		PrimaryKey: []string{"id"},
+		Uniques:    [][]string{{"slug"}},
+		ForeignKeys: []foreignKeyInfo{{
+			Columns:         []string{"author_id"},
+			RefSchema:       "public",
+			RefTable:        "users",
+			RefColumns:      []string{"id"},
+			RefTableColumns: []string{"id", "email"},
+		}},
+	}, enums)
+	tmust(t, err)
+	assert.Equal(t, "BlogPost", table.Model)
+	assert.Equal(t, "blog.blog_posts", table.SQLTable)
+	table.Loaders = table.ForeignKeys
+
+	code := map[string]string{}
+	for filename, render := range map[string]struct {
+		template string
+		data     any
+	}{
+		"models/blog_post.go":   {modelGoCodeTemplate, table},
+		"models/enums_gen.go":   {enumsGoCodeTemplate, newGeneratedEnums(enums)},
+		"db/blog_posts_gen.go":  {repositoryGoCodeTemplate, table},
+		"web/blog_posts_gen.go": {handlersGoCodeTemplate, table},
+		"web/routes_gen.go":     {routesGoCodeTemplate, []string{"BlogPosts"}},
+	} {
+		file, err := renderGeneratedFile(filename, render.template, render.data)
+		assert.NoError(t, err, filename)
+		assert.True(t, generatedCodeRegex.Match(file.Code), filename)
+		code[filename] = string(file.Code)
+	}
+	assert.Regexp(t, `Status\s+PostStatus`, code["models/blog_post.go"])
+	assert.Contains(t, code["db/blog_posts_gen.go"], "GetBySlug")
+	assert.Contains(t, code["db/blog_posts_gen.go"], "LoadAuthor")
+	assert.Contains(t, code["db/blog_posts_gen.go"], "updated_at = ?")
+	assert.Contains(t, code["web/blog_posts_gen.go"], "s.mustWriteRow(c, repo.Delete(")
+	assert.Contains(t, code["web/routes_gen.go"], "BlogPosts")
+}
+
+func tmust(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/iancoleman/strcase"
+)
+
+// Overrides for the Go types of generated model fields, read from the file
+// given by "db generate --config", e.g.
+//
+//	{
+//	  "types": {"numeric": {"type": "decimal.Decimal", "import": "github.com/shopspring/decimal"}},
+//	  "columns": {"users.email": {"type": "string"}},
+//	  "irregulars": {"staff": "staff_member"}
+//	}
+//
+// Types are keyed by Postgres type name (its "udt_name") and columns by
+// "table.column", which take precedence. Overridden types are used as is,
+// so nullable columns need a nilable type like "*decimal.Decimal".
+// Irregulars map plural words to their singular for model names.
+type generateConfig struct {
+	Types      map[string]goType `json:"types"`
+	Columns    map[string]goType `json:"columns"`
+	Irregulars map[string]string `json:"irregulars"`
+
+	inflector *inflector
+}
+
+type goType struct {
+	Type   string `json:"type"`
+	Import string `json:"import"`
+
+	nilable bool // NULL scans to the zero value so no pointer is needed.
+}
+
+func loadGenerateConfig(filename string, required bool) (generateConfig, error) {
+	var config generateConfig
+	bs, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		bs, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(bs, &config); err != nil {
+		return config, fmt.Errorf("parsing %q: %w", filename, err)
+	}
+	config.inflector = newInflector(config.Irregulars)
+	return config, nil
+}
+
+// The singular of a table name, e.g. "user_addresses" is "user_address".
+func (c generateConfig) singular(tableName string) string {
+	return c.inflector.singular(tableName)
+}
+
+// Postgres types by "udt_name", arrays prefixed with an underscore.
+var postgresGoTypes = map[string]goType{
+	"bool":        {Type: "bool"},
+	"int2":        {Type: "int16"},
+	"int4":        {Type: "int"},
+	"int8":        {Type: "int64"},
+	"float4":      {Type: "float32"},
+	"float8":      {Type: "float64"},
+	"numeric":     {Type: "string"}, // Exact, unlike float64.
+	"money":       {Type: "string"},
+	"text":        {Type: "string"},
+	"varchar":     {Type: "string"},
+	"bpchar":      {Type: "string"},
+	"char":        {Type: "string"},
+	"citext":      {Type: "string"},
+	"name":        {Type: "string"},
+	"uuid":        {Type: "string"},
+	"inet":        {Type: "string"},
+	"cidr":        {Type: "string"},
+	"macaddr":     {Type: "string"},
+	"interval":    {Type: "string"},
+	"time":        {Type: "string"},
+	"timetz":      {Type: "string"},
+	"xml":         {Type: "string"},
+	"bytea":       {Type: "[]byte", nilable: true},
+	"json":        {Type: "json.RawMessage", Import: "encoding/json", nilable: true},
+	"jsonb":       {Type: "json.RawMessage", Import: "encoding/json", nilable: true},
+	"date":        {Type: "*time.Time", Import: "time", nilable: true},
+	"timestamp":   {Type: "*time.Time", Import: "time", nilable: true},
+	"timestamptz": {Type: "*time.Time", Import: "time", nilable: true},
+
+	"_bool":    {Type: "BoolArray", nilable: true},
+	"_int2":    {Type: "Int64Array", nilable: true},
+	"_int4":    {Type: "Int64Array", nilable: true},
+	"_int8":    {Type: "Int64Array", nilable: true},
+	"_float4":  {Type: "Float64Array", nilable: true},
+	"_float8":  {Type: "Float64Array", nilable: true},
+	"_numeric": {Type: "StringArray", nilable: true},
+	"_text":    {Type: "StringArray", nilable: true},
+	"_varchar": {Type: "StringArray", nilable: true},
+	"_bpchar":  {Type: "StringArray", nilable: true},
+	"_citext":  {Type: "StringArray", nilable: true},
+	"_uuid":    {Type: "StringArray", nilable: true},
+}
+
+// The Go type of a column in the models package, with a pointer for
+// nullable columns unless NULL already has a representation.
+func typeFor(config generateConfig, table string, column tableInfo, enums map[string][]string) (goType, error) {
+	if override, ok := config.Columns[table+"."+column.Name]; ok {
+		return override, nil
+	}
+	if override, ok := config.Types[column.UdtName]; ok {
+		return override, nil
+	}
+
+	t, ok := postgresGoTypes[column.UdtName]
+	switch {
+	case ok:
+	case enums[column.UdtName] != nil:
+		t = goType{Type: enumTypeFor(column.UdtName)}
+	case strings.HasPrefix(column.UdtName, "_") && enums[column.UdtName[1:]] != nil:
+		t = goType{Type: "StringArray", nilable: true}
+	default:
+		return t, fmt.Errorf("unhandled postgres type %q (%v) for column %q of table %q, set its Go type in the generate config",
+			column.UdtName, column.Type, column.Name, table)
+	}
+	if column.Nullable && !t.nilable {
+		t.Type = "*" + t.Type
+	}
+	return t, nil
+}
+
+func enumTypeFor(enumName string) string {
+	return strcase.ToCamel(enumName)
+}
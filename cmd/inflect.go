@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Plural to singular English nouns, for words the rules below get wrong.
+var defaultIrregulars = map[string]string{
+	"people":    "person",
+	"men":       "man",
+	"women":     "woman",
+	"children":  "child",
+	"mice":      "mouse",
+	"geese":     "goose",
+	"feet":      "foot",
+	"teeth":     "tooth",
+	"oxen":      "ox",
+	"heroes":    "hero",
+	"potatoes":  "potato",
+	"tomatoes":  "tomato",
+	"echoes":    "echo",
+	"vetoes":    "veto",
+	"criteria":  "criterion",
+	"phenomena": "phenomenon",
+}
+
+// Words with the same singular and plural form.
+var uncountables = map[string]bool{
+	"data": true, "metadata": true, "equipment": true, "information": true, "news": true,
+	"series": true, "species": true, "sheep": true, "fish": true, "deer": true, "staff": true,
+	"chassis": true, "tennis": true,
+}
+
+// Singular words ending in "s", pluralized with "es", e.g. "status" and
+// "statuses", where other words ending in "s" are plurals like "menus".
+var singularsEndingInS = map[string]bool{
+	"abacus": true, "alias": true, "apparatus": true, "atlas": true, "bias": true, "bonus": true,
+	"bus": true, "cactus": true, "calculus": true, "campus": true, "canvas": true, "census": true,
+	"chorus": true, "circus": true, "consensus": true, "corpus": true, "focus": true, "fungus": true,
+	"gas": true, "genus": true, "iris": true, "lens": true, "nexus": true, "nucleus": true,
+	"octopus": true, "pelvis": true, "prospectus": true, "radius": true, "stimulus": true,
+	"status": true, "surplus": true, "syllabus": true, "trellis": true, "virus": true,
+}
+
+// Suffix rules, the first match wins and unmatched words are left as is, so
+// rules for specific words come before the general ones they'd fall under.
+var singularRules = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(quiz)zes$`), "$1"},
+	{regexp.MustCompile(`(matr|append)ices$`), "${1}ix"},
+	{regexp.MustCompile(`(vert|ind)ices$`), "${1}ex"},
+	{regexp.MustCompile(`(analy|cri|diagno|oa|parenthe|progno|synop|the)ses$`), "${1}sis"},
+	{regexp.MustCompile(`(ss|sis|^axis)$`), "$1"}, // Already singular, e.g. "address", "analysis", "axis".
+	// Words ending in "che", unlike "beaches" and "coaches".
+	{regexp.MustCompile(`((?:^|[^eo])ache|avalanche|cliche|moustache|niche|psyche|quiche)s$`), "$1"},
+	// Only sibilants take "es", unlike "houses" and "sizes".
+	{regexp.MustCompile(`(ss|sh|ch|x|zz|tz)es$`), "$1"},
+	// Words ending in "ie", unlike "parties" and "cities".
+	{regexp.MustCompile(`^([dlpv]|(?:bow|neck)?t|brown|calor|cook|cut|faer|food|freeb|gen|goal|hipp|hood|lass|mov|newb|pix|rook|self|smooth|sort|zomb)ies$`), "${1}ie"},
+	{regexp.MustCompile(`([^aeiouy]|qu)ies$`), "${1}y"},
+	{regexp.MustCompile(`(^|[^o])(wi|kni|li)ves$`), "${1}${2}fe"}, // Unlike "olives".
+	{regexp.MustCompile(`(hal|el|shel|wol|lea|loa|thie|cal)ves$`), "${1}f"},
+	{regexp.MustCompile(`s$`), ""},
+}
+
+// Converts plural table names to singular model names, with irregular words
+// from defaultIrregulars and any overrides.
+type inflector struct {
+	irregulars map[string]string
+}
+
+func newInflector(overrides map[string]string) *inflector {
+	irregulars := map[string]string{}
+	for plural, singular := range defaultIrregulars {
+		irregulars[plural] = singular
+	}
+	for plural, singular := range overrides {
+		irregulars[strings.ToLower(plural)] = singular
+	}
+	return &inflector{irregulars}
+}
+
+// The singular of a snake case name, only its last word is inflected,
+// e.g. "user_addresses" becomes "user_address".
+func (i *inflector) singular(name string) string {
+	prefix, word := "", name
+	if n := strings.LastIndex(name, "_"); n >= 0 {
+		prefix, word = name[:n+1], name[n+1:]
+	}
+	lower := strings.ToLower(word)
+	if singular, ok := i.irregulars[lower]; ok {
+		return prefix + singular
+	}
+	if uncountables[lower] || singularsEndingInS[lower] {
+		return name
+	}
+	if stem := strings.TrimSuffix(lower, "es"); stem != lower && singularsEndingInS[stem] {
+		return prefix + stem
+	}
+	for _, rule := range singularRules {
+		if rule.pattern.MatchString(lower) {
+			return prefix + rule.pattern.ReplaceAllString(lower, rule.replacement)
+		}
+	}
+	return name
+}
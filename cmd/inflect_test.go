@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflectorSingular(t *testing.T) {
+	inflector := newInflector(map[string]string{"Staff": "staff_member"})
+	for plural, singular := range map[string]string{
+		"users":          "user",
+		"blog_posts":     "blog_post",
+		"categories":     "category",
+		"statuses":       "status",
+		"addresses":      "address",
+		"user_addresses": "user_address",
+		"boxes":          "box",
+		"matches":        "match",
+		"wishes":         "wish",
+		"analyses":       "analysis",
+		"indices":        "index",
+		"matrices":       "matrix",
+		"knives":         "knife",
+		"halves":         "half",
+		"archives":       "archive",
+		"people":         "person",
+		"children":       "child",
+		"movies":         "movie",
+		"heroes":         "hero",
+		"keys":           "key",
+		"series":         "series",
+		"user_metadata":  "user_metadata",
+		"staff":          "staff_member",
+		"status":         "status",
+		"person":         "person",
+		"databases":      "database",
+		"bases":          "base",
+		"hypotheses":     "hypothesis",
+		"aliases":        "alias",
+		"caches":         "cache",
+		"headaches":      "headache",
+		"coaches":        "coach",
+		"beaches":        "beach",
+		"niches":         "niche",
+		"menus":          "menu",
+		"olives":         "olive",
+		"lives":          "life",
+		"midwives":       "midwife",
+		"shelves":        "shelf",
+		"haikus":         "haiku",
+		"gurus":          "guru",
+		"pies":           "pie",
+		"ties":           "tie",
+		"neckties":       "necktie",
+		"calories":       "calorie",
+		"cookies":        "cookie",
+		"zombies":        "zombie",
+		"parties":        "party",
+		"cities":         "city",
+		"houses":         "house",
+		"causes":         "cause",
+		"sizes":          "size",
+		"buzzes":         "buzz",
+		"waltzes":        "waltz",
+		"quizzes":        "quiz",
+		"crises":         "crisis",
+		"taxis":          "taxi",
+		"emojis":         "emoji",
+		"axis":           "axis",
+		"bonus":          "bonus",
+		"bonuses":        "bonus",
+		"campuses":       "campus",
+		"buses":          "bus",
+		"gases":          "gas",
+		"user_status":    "user_status",
+		"moustaches":     "moustache",
+		"shoes":          "shoe",
+		"tennis":         "tennis",
+	} {
+		assert.Equal(t, singular, inflector.singular(plural), plural)
+	}
+}
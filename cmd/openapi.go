@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"webapp/web"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/maerics/golog"
+	cobra "github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(openapiCmd)
+
+	openapiCmd.Flags().StringVarP(&optOpenapiOutput,
+		"output", "o", defaultOpenapiOutputFilename, `the file to write, or "-" for stdout`)
+}
+
+var (
+	optOpenapiOutput = defaultOpenapiOutputFilename
+)
+
+const defaultOpenapiOutputFilename = "openapi.json"
+
+var openapiCmd = &cobra.Command{
+	Use:   "openapi",
+	Short: "Write the OpenAPI document of the /api/v1 routes",
+	Long: `Write the OpenAPI 3.1 document served at /api/v1/openapi.json, for
+generating API clients, without connecting to the database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config := web.Config{
+			Mode:    gin.ReleaseMode,
+			BaseURL: strings.TrimSuffix(os.Getenv(Env_BASE_URL), "/"),
+			Build:   web.GetBuildInfo(),
+		}
+		server := must1(web.NewServer(config, nil))
+		doc := append(must1(json.MarshalIndent(server.OpenAPI(), "", "  ")), '\n')
+
+		if optOpenapiOutput == "-" {
+			must1(os.Stdout.Write(doc))
+			return
+		}
+		must(os.WriteFile(optOpenapiOutput, doc, os.FileMode(0o644)))
+		log.Printf("wrote %q", optOpenapiOutput)
+	},
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"os"
 	"strings"
 	"webapp/db"
@@ -14,8 +15,23 @@ import (
 
 func init() {
 	rootCmd.AddCommand(webCmd)
+
+	webCmd.Flags().BoolVarP(&optWebMigrate,
+		"migrate", "m", false, "run pending database migrations before starting")
+	webCmd.Flags().DurationVarP(&optWebMigrateLockTimeout,
+		"migrate-lock-timeout", "", db.DefaultMigrationLockTimeout,
+		"how long to wait for another process to finish migrating")
+	webCmd.Flags().DurationVarP(&optWebIdempotencyKeysTTL,
+		"idempotency-keys-ttl", "", web.DefaultIdempotencyKeysTTL,
+		"how long to replay responses to requests with an Idempotency-Key header")
 }
 
+var (
+	optWebMigrate            = false
+	optWebMigrateLockTimeout = db.DefaultMigrationLockTimeout
+	optWebIdempotencyKeysTTL = web.DefaultIdempotencyKeysTTL
+)
+
 var webCmd = &cobra.Command{
 	Use:     "web",
 	Aliases: []string{"w"},
@@ -24,17 +40,29 @@ var webCmd = &cobra.Command{
 		var dbh *db.DB = nil
 		if dburl := strings.TrimSpace(os.Getenv(Env_DATABASE_URL)); dburl != "" {
 			dbh = must1(db.Connect(dburl))
+			if replicaURL := strings.TrimSpace(os.Getenv(Env_DATABASE_REPLICA_URL)); replicaURL != "" {
+				must(dbh.ConnectReplica(replicaURL))
+			}
+			if optWebMigrate {
+				dbh.MigrationLockTimeout = optWebMigrateLockTimeout
+				must(dbh.Migrate())
+			}
 		} else {
 			log.Printf("skipping database, set %q to connect", Env_DATABASE_URL)
 		}
 
 		config := web.Config{
 			Mode:                 util.Getenv(Env_GIN_MODE, gin.DebugMode),
+			BaseURL:              strings.TrimSuffix(os.Getenv(Env_BASE_URL), "/"),
 			Build:                web.GetBuildInfo(),
 			CookieEncryptionKeys: cookieEncryptionKeysFromEnv(),
+			IdempotencyKeysTTL:   optWebIdempotencyKeysTTL,
 		}
 
 		server := must1(web.NewServer(config, dbh))
+		if server.IdempotencyKeys != nil {
+			go server.ExpireIdempotencyKeys(context.Background(), web.IdempotencyKeysExpireInterval)
+		}
 		must(server.Run())
 	},
 }
@@ -1,7 +1,10 @@
 package db
 
 import (
+	"database/sql"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/maerics/golog"
 	"github.com/maerics/goutil"
@@ -21,3 +24,103 @@ func TestDbIsSqlDatabase(t *testing.T) {
 	}
 	assert.Equal(t, 1, one)
 }
+
+func TestParseOptions(t *testing.T) {
+	t.Setenv(Env_DATABASE_MAX_OPEN_CONNS, "20")
+	t.Setenv(Env_DATABASE_CONN_MAX_IDLE_TIME, "5m")
+
+	u, err := url.Parse("postgres://u:p@localhost/webapp?sslmode=disable&max_open_conns=10&conn_max_lifetime=1h")
+	assert.NoError(t, err)
+	opts, err := parseOptions(u)
+	assert.NoError(t, err)
+	assert.Equal(t, Options{
+		MaxOpenConns:    10,
+		MaxIdleConns:    2,
+		ConnMaxLifetime: time.Hour,
+		ConnMaxIdleTime: 5 * time.Minute,
+		ConnectAttempts: 6,
+		MaxReplicaLag:   10 * time.Second,
+
+		SlowQueryThreshold: 200 * time.Millisecond,
+		QueryTimeout:       30 * time.Second,
+	}, opts)
+	assert.Equal(t, "sslmode=disable", u.RawQuery)
+
+	for _, invalid := range []string{"max_idle_conns=x", "max_open_conns=-1", "conn_max_lifetime=1"} {
+		u, err := url.Parse("postgres://localhost/webapp?" + invalid)
+		assert.NoError(t, err)
+		_, err = parseOptions(u)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReaderFallsBackToPrimary(t *testing.T) {
+	testdb := MustConnectTestDB()
+	assert.Same(t, testdb, testdb.Reader())
+
+	if err := testdb.ConnectReplica(goutil.MustEnv(Env_TEST_DATABASE_URL)); err != nil {
+		t.Fatal(err)
+	}
+	replica := testdb.Reader()
+	assert.NotSame(t, testdb, replica)
+	var one int
+	assert.NoError(t, replica.Get(&one, "SELECT 1"))
+
+	// An unreachable replica is skipped after its next health check.
+	assert.NoError(t, replica.Close())
+	testdb.replica.refresh()
+	assert.Same(t, testdb, testdb.Reader())
+}
+
+func TestConnectUnreachableReplica(t *testing.T) {
+	testdb := MustConnectTestDB()
+	replicaURL := "sqlite3:///nonexistent/replica.db"
+	if testdb.Dialect == DialectPostgres {
+		replicaURL = "postgres://localhost:1/replica?connect_timeout=1"
+	}
+	assert.NoError(t, testdb.ConnectReplica(replicaURL))
+	assert.False(t, testdb.replica.healthy.Load())
+	assert.Same(t, testdb, testdb.Reader())
+	assert.Error(t, testdb.ConnectReplica("mysql://localhost/replica"))
+}
+
+func TestQueryStats(t *testing.T) {
+	testdb := MustConnectTestDB()
+	testdb.SlowQueryThreshold = time.Nanosecond
+	before := testdb.QueryStats()
+
+	var one int
+	assert.NoError(t, testdb.Get(&one, "SELECT 1"))
+	assert.Error(t, testdb.Get(&one, "SELECT nope FROM nowhere"))
+	_, err := testdb.NamedExec("SELECT :one", map[string]any{"one": 1})
+	assert.NoError(t, err)
+	testdb.MustExec("SELECT 1")
+
+	after := testdb.QueryStats()
+	assert.Equal(t, before.Queries+4, after.Queries)
+	assert.Equal(t, before.Errors+1, after.Errors)
+	assert.Equal(t, before.SlowQueries+4, after.SlowQueries)
+	assert.Less(t, before.TotalTime, after.TotalTime)
+}
+
+// Counts to a hundred million, which takes well over a second.
+const slowTestQuery = `WITH RECURSIVE r(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM r WHERE i < 100000000) SELECT COUNT(*) FROM r`
+
+func TestQueryTimeout(t *testing.T) {
+	testdb := MustConnectTestDB()
+	testdb.QueryTimeout = 50 * time.Millisecond
+
+	var count int
+	t0 := time.Now()
+	err := testdb.Get(&count, slowTestQuery)
+	assert.True(t, IsTimeout(err), "expected a timeout, got %v", err)
+	assert.Less(t, time.Since(t0), time.Second)
+
+	rows, err := testdb.Query("SELECT 1")
+	assert.NoError(t, err)
+	for rows.Next() {
+	}
+	assert.NoError(t, rows.Err())
+	assert.NoError(t, rows.Close())
+	assert.False(t, IsTimeout(sql.ErrNoRows))
+}
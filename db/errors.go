@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Postgres SQLSTATE for a statement canceled by a timeout or cancel request.
+	postgresQueryCanceled = "57014"
+
+	// Postgres SQLSTATE and SQLite extended result codes for duplicate keys.
+	postgresUniqueViolation    = "23505"
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+// Returned by repositories without a database for duplicate unique keys,
+// like the unique violation errors of the database drivers.
+var ErrUniqueViolation = errors.New("unique violation")
+
+// Returned by conditional writes of a row whose version has changed since
+// it was read, e.g. by another client.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// Report whether a query failed by running out of time, either from its
+// context deadline (see QueryTimeout) or the server's statement_timeout.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == postgresQueryCanceled
+}
+
+// Report whether a write failed on a duplicate primary or unique key.
+func IsUniqueViolation(err error) bool {
+	if errors.Is(err, ErrUniqueViolation) {
+		return true
+	}
+	var sqlErr interface{ SQLState() string }
+	if errors.As(err, &sqlErr) {
+		return sqlErr.SQLState() == postgresUniqueViolation
+	}
+	var sqliteErr interface{ Code() int }
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqliteConstraintUnique || sqliteErr.Code() == sqliteConstraintPrimaryKey
+	}
+	return false
+}
+
+// Drivers don't always say why a query was interrupted, SQLite reports just
+// "interrupted (9)", so the context's error is attached to theirs.
+func interrupted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return interruptedError{err, ctx.Err()}
+}
+
+type interruptedError struct{ err, cause error }
+
+func (e interruptedError) Error() string        { return fmt.Sprintf("%v: %v", e.cause, e.err) }
+func (e interruptedError) Unwrap() error        { return e.err }
+func (e interruptedError) Is(target error) bool { return errors.Is(e.cause, target) }
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const IdempotencyKeysTablename = "idempotency_keys"
+
+// The stored response of the first request with an idempotency key, whose
+// status is zero while it is in progress.
+type IdempotencyRecord struct {
+	Key         string    `db:"key"`
+	Fingerprint string    `db:"fingerprint"`
+	Status      int       `db:"status"`
+	Headers     string    `db:"headers"` // A JSON object of header values.
+	Body        []byte    `db:"body"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// Storage for the responses of requests with idempotency keys.
+type IdempotencyKeyRepository interface {
+	// Claim a key for a request, unless a request with the key was made
+	// since the given time, whose record is returned instead.
+	Claim(ctx context.Context, key, fingerprint string, since time.Time) (IdempotencyRecord, bool, error)
+	// Store the response of a claimed key, sql.ErrNoRows if it expired.
+	Complete(ctx context.Context, record IdempotencyRecord) error
+	// Forget a claimed key without a response, so it can be retried.
+	Release(ctx context.Context, key string) error
+	// Forget the keys claimed before the given time.
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+const idempotencyColumns = "key, fingerprint, status, headers, body, created_at"
+
+type sqlIdempotencyKeyRepository struct {
+	db *DB
+}
+
+// Store idempotency keys in the "idempotency_keys" table, always on the
+// primary since every read is followed by a write.
+func NewIdempotencyKeyRepository(db *DB) IdempotencyKeyRepository {
+	return &sqlIdempotencyKeyRepository{db}
+}
+
+func (r *sqlIdempotencyKeyRepository) Claim(ctx context.Context, key, fingerprint string, since time.Time) (IdempotencyRecord, bool, error) {
+	expire := r.db.Rebind("DELETE FROM " + IdempotencyKeysTablename + " WHERE key = ? AND created_at < ?")
+	if _, err := r.db.ExecContext(ctx, expire, key, r.db.TimeArg(since)); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	insert := r.db.Rebind("INSERT INTO " + IdempotencyKeysTablename + " (key, fingerprint) VALUES (?, ?) ON CONFLICT (key) DO NOTHING")
+	result, err := r.db.ExecContext(ctx, insert, key, fingerprint)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return IdempotencyRecord{Key: key, Fingerprint: fingerprint}, err == nil, err
+	}
+
+	var record IdempotencyRecord
+	query := r.db.Rebind("SELECT " + idempotencyColumns + " FROM " + IdempotencyKeysTablename + " WHERE key = ?")
+	err = r.db.GetContext(ctx, &record, query, key)
+	return record, false, err
+}
+
+func (r *sqlIdempotencyKeyRepository) Complete(ctx context.Context, record IdempotencyRecord) error {
+	query := r.db.Rebind("UPDATE " + IdempotencyKeysTablename + " SET status = ?, headers = ?, body = ? WHERE key = ?")
+	result, err := r.db.ExecContext(ctx, query, record.Status, record.Headers, record.Body, record.Key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlIdempotencyKeyRepository) Release(ctx context.Context, key string) error {
+	query := r.db.Rebind("DELETE FROM " + IdempotencyKeysTablename + " WHERE key = ? AND status = 0")
+	_, err := r.db.ExecContext(ctx, query, key)
+	return err
+}
+
+func (r *sqlIdempotencyKeyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	query := r.db.Rebind("DELETE FROM " + IdempotencyKeysTablename + " WHERE created_at < ?")
+	result, err := r.db.ExecContext(ctx, query, r.db.TimeArg(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+type memoryIdempotencyKeyRepository struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+// Store idempotency keys in memory, e.g. for tests.
+func NewMemoryIdempotencyKeyRepository() IdempotencyKeyRepository {
+	return &memoryIdempotencyKeyRepository{records: map[string]IdempotencyRecord{}}
+}
+
+func (r *memoryIdempotencyKeyRepository) Claim(ctx context.Context, key, fingerprint string, since time.Time) (IdempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if record, ok := r.records[key]; ok && !record.CreatedAt.Before(since) {
+		return record, false, nil
+	}
+	record := IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now().UTC()}
+	r.records[key] = record
+	return record, true, nil
+}
+
+func (r *memoryIdempotencyKeyRepository) Complete(ctx context.Context, record IdempotencyRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.records[record.Key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	existing.Status, existing.Headers, existing.Body = record.Status, record.Headers, record.Body
+	r.records[record.Key] = existing
+	return nil
+}
+
+func (r *memoryIdempotencyKeyRepository) Release(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.records[key].Status == 0 {
+		delete(r.records, key)
+	}
+	return nil
+}
+
+func (r *memoryIdempotencyKeyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := int64(0)
+	for key, record := range r.records {
+		if record.CreatedAt.Before(before) {
+			delete(r.records, key)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKeyRepositories(t *testing.T) {
+	testdb := MustConnectTestDB()
+	assert.NoError(t, testdb.Migrate())
+	_, err := testdb.Exec("DELETE FROM " + IdempotencyKeysTablename)
+	assert.NoError(t, err)
+
+	for name, repo := range map[string]IdempotencyKeyRepository{
+		"sql":    NewIdempotencyKeyRepository(testdb),
+		"memory": NewMemoryIdempotencyKeyRepository(),
+	} {
+		t.Run(name, func(t *testing.T) { testIdempotencyKeyRepository(t, repo) })
+	}
+}
+
+func testIdempotencyKeyRepository(t *testing.T, repo IdempotencyKeyRepository) {
+	ctx := context.Background()
+	hourAgo := time.Now().Add(-time.Hour)
+
+	record, claimed, err := repo.Claim(ctx, "key1", "fingerprint1", hourAgo)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, "key1", record.Key)
+
+	record, claimed, err = repo.Claim(ctx, "key1", "fingerprint2", hourAgo)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "fingerprint1", record.Fingerprint)
+	assert.Equal(t, 0, record.Status, "in progress")
+
+	record.Status, record.Headers, record.Body = 201, `{"Content-Type":["application/json"]}`, []byte(`{"id":1}`)
+	assert.NoError(t, repo.Complete(ctx, record))
+	assert.NoError(t, repo.Release(ctx, "key1"), "completed keys stay")
+	got, claimed, err := repo.Claim(ctx, "key1", "fingerprint1", hourAgo)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, 201, got.Status)
+	assert.Equal(t, record.Headers, got.Headers)
+	assert.Equal(t, record.Body, got.Body)
+
+	_, claimed, err = repo.Claim(ctx, "key2", "fingerprint2", hourAgo)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.NoError(t, repo.Release(ctx, "key2"))
+	_, claimed, err = repo.Claim(ctx, "key2", "fingerprint3", hourAgo)
+	assert.NoError(t, err)
+	assert.True(t, claimed, "released keys can be claimed again")
+	assert.ErrorIs(t, repo.Complete(ctx, IdempotencyRecord{Key: "key3", Status: 200}), sql.ErrNoRows)
+
+	// Keys expire.
+	future := time.Now().Add(time.Hour)
+	_, claimed, err = repo.Claim(ctx, "key1", "fingerprint4", future)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	n, err := repo.DeleteExpired(ctx, future)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/maerics/golog"
+)
+
+// Identifies the request which triggered a query in the slow query log.
+type QueryTags struct {
+	RequestID string
+	Route     string
+}
+
+type queryTagsKey struct{}
+
+func WithQueryTags(ctx context.Context, tags QueryTags) context.Context {
+	return context.WithValue(ctx, queryTagsKey{}, tags)
+}
+
+func queryTagsFrom(ctx context.Context) QueryTags {
+	tags, _ := ctx.Value(queryTagsKey{}).(QueryTags)
+	return tags
+}
+
+// A snapshot of the queries run through a database and its read replica.
+type QueryStats struct {
+	Queries     int64         `json:"queries"`
+	Errors      int64         `json:"errors"`
+	SlowQueries int64         `json:"slow_queries"`
+	TotalTime   time.Duration `json:"total_time_ns"`
+}
+
+type queryStats struct {
+	queries, errors, slowQueries, totalTime atomic.Int64
+}
+
+func (db *DB) QueryStats() QueryStats {
+	return QueryStats{
+		Queries:     db.stats.queries.Load(),
+		Errors:      db.stats.errors.Load(),
+		SlowQueries: db.stats.slowQueries.Load(),
+		TotalTime:   time.Duration(db.stats.totalTime.Load()),
+	}
+}
+
+// The methods below shadow those of the embedded *sqlx.DB so that every
+// query is canceled after QueryTimeout, timed, counted, and logged if slower
+// than SlowQueryThreshold.
+//
+// Others bypass all of that: Queryx and QueryRowx, whose rows can't release
+// the timeout once read, and the statements of transactions and prepared
+// statements from Beginx and Preparex, which may well need to run longer
+// than a query, e.g. migrations. Pass them a context with a deadline.
+
+func (db *DB) Get(dest any, query string, args ...any) error {
+	return db.GetContext(context.Background(), dest, query, args...)
+}
+
+func (db *DB) GetContext(ctx context.Context, dest any, query string, args ...any) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	err := db.DB.GetContext(ctx, dest, query, args...)
+	err = interrupted(ctx, err)
+	db.observe(ctx, query, len(args), t0, err)
+	return err
+}
+
+func (db *DB) Select(dest any, query string, args ...any) error {
+	return db.SelectContext(context.Background(), dest, query, args...)
+}
+
+func (db *DB) SelectContext(ctx context.Context, dest any, query string, args ...any) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	err := db.DB.SelectContext(ctx, dest, query, args...)
+	err = interrupted(ctx, err)
+	db.observe(ctx, query, len(args), t0, err)
+	return err
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	t0 := time.Now()
+	result, err := db.DB.ExecContext(ctx, query, args...)
+	err = interrupted(ctx, err)
+	db.observe(ctx, query, len(args), t0, err)
+	return result, err
+}
+
+func (db *DB) MustExec(query string, args ...any) sql.Result {
+	return db.MustExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) MustExecContext(ctx context.Context, query string, args ...any) sql.Result {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func (db *DB) NamedExec(query string, arg any) (sql.Result, error) {
+	return db.NamedExecContext(context.Background(), query, arg)
+}
+
+func (db *DB) NamedExecContext(ctx context.Context, query string, arg any) (sql.Result, error) {
+	bound, args, err := db.BindNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, bound, args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// Only the time to the first row is measured since the caller owns the rows,
+// which hold the query timeout until they are closed or fully read.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	t0 := time.Now()
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	err = interrupted(ctx, err)
+	db.observe(ctx, query, len(args), t0, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Rows{Rows: rows, ctx: ctx, cancel: cancel}, nil
+}
+
+// Result rows which release their query timeout once done.
+type Rows struct {
+	*sql.Rows
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+func (r *Rows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.err = interrupted(r.ctx, r.Rows.Err())
+	r.cancel()
+	return false
+}
+
+func (r *Rows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Rows.Err()
+}
+
+func (r *Rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+func (db *DB) observe(ctx context.Context, query string, nargs int, t0 time.Time, err error) {
+	elapsed := time.Since(t0)
+	db.stats.queries.Add(1)
+	db.stats.totalTime.Add(int64(elapsed))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		db.stats.errors.Add(1)
+	}
+
+	log.Debugf("query took %v: %v", elapsed, oneLine(query))
+	if db.SlowQueryThreshold > 0 && elapsed >= db.SlowQueryThreshold {
+		db.stats.slowQueries.Add(1)
+		tags := queryTagsFrom(ctx)
+		log.Printf("slow query took %v (request_id=%q, route=%q, %v parameter(s) redacted): %v",
+			elapsed, tags.RequestID, tags.Route, nargs, oneLine(query))
+	}
+}
+
+func oneLine(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
@@ -1,45 +1,506 @@
 package db
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"fmt"
 	"path"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	log "github.com/maerics/golog"
 )
 
-// Migration files MUST be idempotent!
+// Migration files are named "<version>_<name>.up.sql" with an optional
+// "<version>_<name>.down.sql" to undo it; a plain "<version>_<name>.sql" is
+// an irreversible up migration. Files for a single dialect are tagged like
+// "<version>_<name>.sqlite.up.sql". Each one, along with any registered via
+// RegisterMigration, is run at most once, in version order, inside its own
+// transaction.
 const MigrationsDirname = "migrations"
 
+// The table which records the migrations applied to a database.
+const MigrationsTablename = "schema_migrations"
+
+const (
+	migrationUp   = "up"
+	migrationDown = "down"
+)
+
 //go:embed migrations/*
 var migrationsfs embed.FS
 
-func (db *DB) Migrate() error {
-	// Load the migration files and sort by name.
+type Migration struct {
+	Version      int64
+	Name         string
+	Filename     string
+	Checksum     string
+	Up           string
+	DownFilename string
+	Down         string
+
+	// Set instead of the SQL queries for migrations registered in Go.
+	UpFunc   MigrationFunc
+	DownFunc MigrationFunc
+}
+
+func (m Migration) Reversible() bool {
+	return m.DownFilename != ""
+}
+
+func (m Migration) IsGo() bool {
+	return m.UpFunc != nil
+}
+
+type AppliedMigration struct {
+	Version   int64      `db:"version"`
+	Filename  string     `db:"filename"`
+	Checksum  string     `db:"checksum"`
+	AppliedAt *time.Time `db:"applied_at"`
+}
+
+// Load the embedded migration files for the given dialect sorted by version.
+// Files tagged for another dialect are skipped and those tagged for this one
+// take precedence over untagged files with the same version and direction.
+func LoadMigrations(dialect string) ([]Migration, error) {
 	entries, err := migrationsfs.ReadDir(MigrationsDirname)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
 
-	// Run each migration in sequence.
+	// Select the most specific file for each version and direction.
+	files := map[int64]map[string]migrationFile{}
 	for _, entry := range entries {
-		log.Debugf("running migration %q", entry.Name())
-		filename := path.Join(MigrationsDirname, entry.Name())
-		query, err := migrationsfs.ReadFile(filename)
+		file, err := parseMigrationFilename(entry.Name())
 		if err != nil {
-			return fmt.Errorf("reading %q: %w",
-				path.Join(MigrationsDirname, entry.Name()), err)
+			return nil, err
+		}
+		if file.Dialect != "" && file.Dialect != dialect {
+			continue
+		}
+		if files[file.Version] == nil {
+			files[file.Version] = map[string]migrationFile{}
+		}
+		other, ok := files[file.Version][file.Direction]
+		switch {
+		case ok && other.Name != file.Name:
+			return nil, fmt.Errorf("conflicting names for migration version %v in %q and %q", file.Version, other.Filename, file.Filename)
+		case ok && other.Dialect == file.Dialect:
+			return nil, fmt.Errorf("duplicate %v migration version %v in %q and %q", file.Direction, file.Version, other.Filename, file.Filename)
+		case ok && other.Dialect != "":
+			continue
+		}
+		files[file.Version][file.Direction] = file
+	}
+
+	migrations := []Migration{}
+	for version, byDirection := range files {
+		up, ok := byDirection[migrationUp]
+		if !ok {
+			return nil, fmt.Errorf("down migration %q has no matching up migration", byDirection[migrationDown].Filename)
+		}
+		query, err := readMigrationFile(up.Filename)
+		if err != nil {
+			return nil, err
+		}
+		migration := Migration{
+			Version:  version,
+			Name:     up.Name,
+			Filename: up.Filename,
+			Checksum: checksum(query),
+			Up:       string(query),
+		}
+		if down, ok := byDirection[migrationDown]; ok {
+			if down.Name != up.Name {
+				return nil, fmt.Errorf("conflicting names for migration version %v in %q and %q", version, up.Filename, down.Filename)
+			}
+			query, err := readMigrationFile(down.Filename)
+			if err != nil {
+				return nil, err
+			}
+			migration.DownFilename = down.Filename
+			migration.Down = string(query)
+		}
+		migrations = append(migrations, migration)
+	}
+	for _, migration := range goMigrations {
+		if up, ok := files[migration.Version][migrationUp]; ok {
+			return nil, fmt.Errorf("duplicate migration version %v in %q and %q", migration.Version, up.Filename, migration.Filename)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func readMigrationFile(filename string) ([]byte, error) {
+	bs, err := migrationsfs.ReadFile(path.Join(MigrationsDirname, filename))
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", path.Join(MigrationsDirname, filename), err)
+	}
+	return bs, nil
+}
+
+// Return the migrations recorded as applied, sorted by version, none if the
+// migrations table doesn't exist yet since it is only created to migrate.
+func (db *DB) AppliedMigrations() ([]AppliedMigration, error) {
+	applied := []AppliedMigration{}
+	if exists, err := db.tableExists(MigrationsTablename); err != nil || !exists {
+		return applied, err
+	}
+
+	query := "SELECT version, filename, checksum, applied_at FROM " + MigrationsTablename + " ORDER BY version"
+	if err := db.Select(&applied, query); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// A migration to run in the given direction, "up" or "down".
+type MigrationStep struct {
+	Migration Migration
+	Direction string
+}
+
+func (s MigrationStep) Filename() string {
+	if s.Direction == migrationDown {
+		return s.Migration.DownFilename
+	}
+	return s.Migration.Filename
+}
+
+// The SQL to execute, empty for Go migrations.
+func (s MigrationStep) Query() string {
+	if s.Direction == migrationDown {
+		return s.Migration.Down
+	}
+	return s.Migration.Up
+}
+
+func (s MigrationStep) run(tx *sqlx.Tx) error {
+	f := s.Migration.UpFunc
+	if s.Direction == migrationDown {
+		f = s.Migration.DownFunc
+	}
+	if f != nil {
+		return f(tx)
+	}
+	_, err := tx.Exec(s.Query())
+	return err
+}
+
+// States reported by MigrationStatuses.
+const (
+	MigrationApplied  = "applied"  // Applied and unchanged since.
+	MigrationPending  = "pending"  // Not yet applied.
+	MigrationModified = "modified" // Applied but the file checksum has since changed.
+	MigrationMissing  = "missing"  // Applied but the file no longer exists.
+)
+
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Filename  string     `json:"filename"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Compare the embedded migration files with the applied versions.
+func (db *DB) MigrationStatuses() ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	appliedByVersion := map[int64]AppliedMigration{}
+	for _, a := range applied {
+		appliedByVersion[a.Version] = a
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{
+			Version:  migration.Version,
+			Filename: migration.Filename,
+			State:    MigrationPending,
 		}
-		if _, err := db.DB.Exec(string(query)); err != nil {
-			return fmt.Errorf("executing %q: %w",
-				path.Join(MigrationsDirname, entry.Name()), err)
+		if a, ok := appliedByVersion[migration.Version]; ok {
+			status.State = MigrationApplied
+			if a.Checksum != migration.Checksum {
+				status.State = MigrationModified
+			}
+			status.AppliedAt = a.AppliedAt
+			delete(appliedByVersion, migration.Version)
 		}
+		statuses = append(statuses, status)
 	}
-	log.Printf("successfully ran %v database migration(s)", len(entries))
+	for _, a := range appliedByVersion {
+		statuses = append(statuses, MigrationStatus{
+			Version:   a.Version,
+			Filename:  a.Filename,
+			State:     MigrationMissing,
+			AppliedAt: a.AppliedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// Run every pending migration in sequence.
+func (db *DB) Migrate() error {
+	return db.MigrateTo(0)
+}
+
+// Run the pending migrations up to and including the target version,
+// or all of them if the target is zero.
+func (db *DB) MigrateTo(target int64) error {
+	return db.runMigrationPlan(func() ([]MigrationStep, error) {
+		return db.PlanMigrateTo(target)
+	})
+}
+
+// Undo the given number of most recently applied migrations.
+func (db *DB) Rollback(count int) error {
+	return db.runMigrationPlan(func() ([]MigrationStep, error) {
+		return db.PlanRollback(count)
+	})
+}
+
+// Undo every applied migration newer than the target version,
+// so a target of zero undoes all of them.
+func (db *DB) RollbackTo(target int64) error {
+	return db.runMigrationPlan(func() ([]MigrationStep, error) {
+		return db.PlanRollbackTo(target)
+	})
+}
+
+// Plan and run the migration steps while holding the migrations lock so
+// that concurrent processes never plan against a stale set of versions.
+func (db *DB) runMigrationPlan(plan func() ([]MigrationStep, error)) error {
+	return db.withMigrationsLock(func() error {
+		if err := db.createMigrationsTable(); err != nil {
+			return err
+		}
+		steps, err := plan()
+		if err != nil {
+			return err
+		}
+		return db.runMigrationSteps(steps)
+	})
+}
+
+// Return the pending migrations up to and including the target version,
+// or all of them if the target is zero.
+func (db *DB) PlanMigrateTo(target int64) ([]MigrationStep, error) {
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	if target != 0 && !hasVersion(migrations, target) {
+		return nil, fmt.Errorf("unknown migration version %v", target)
+	}
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	appliedVersions := map[int64]bool{}
+	for _, a := range applied {
+		appliedVersions[a.Version] = true
+	}
+
+	steps := []MigrationStep{}
+	for _, migration := range migrations {
+		if target != 0 && migration.Version > target {
+			break
+		}
+		if !appliedVersions[migration.Version] {
+			steps = append(steps, MigrationStep{migration, migrationUp})
+		}
+	}
+	return steps, nil
+}
+
+// Return the down migrations for the given number of most recently
+// applied migrations, newest first.
+func (db *DB) PlanRollback(count int) ([]MigrationStep, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("rollback steps must be positive, got %v", count)
+	}
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if count > len(applied) {
+		count = len(applied)
+	}
+	return db.planRollback(applied[len(applied)-count:])
+}
+
+// Return the down migrations for every applied migration newer than
+// the target version, newest first.
+func (db *DB) PlanRollbackTo(target int64) ([]MigrationStep, error) {
+	if target < 0 {
+		return nil, fmt.Errorf("invalid rollback version %v", target)
+	}
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(applied), func(i int) bool { return applied[i].Version > target })
+	return db.planRollback(applied[i:])
+}
+
+// Make sure every applied version can be undone before changing anything.
+func (db *DB) planRollback(applied []AppliedMigration) ([]MigrationStep, error) {
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]Migration{}
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+
+	steps := []MigrationStep{}
+	for i := len(applied) - 1; i >= 0; i-- {
+		migration, ok := byVersion[applied[i].Version]
+		if !ok {
+			return nil, fmt.Errorf("applied migration %q not found in %q", applied[i].Filename, MigrationsDirname)
+		}
+		if !migration.Reversible() {
+			return nil, fmt.Errorf("migration %q is irreversible", applied[i].Filename)
+		}
+		steps = append(steps, MigrationStep{migration, migrationDown})
+	}
+	return steps, nil
+}
+
+// Run each planned migration step in sequence.
+func (db *DB) runMigrationSteps(steps []MigrationStep) error {
+	for _, step := range steps {
+		log.Debugf("running migration %q", step.Filename())
+		if err := db.applyMigration(step); err != nil {
+			return fmt.Errorf("executing %q: %w", step.Filename(), err)
+		}
+	}
+	log.Printf("successfully ran %v database migration(s)", len(steps))
 
 	return nil
 }
+
+// Execute the migration and update the applied versions in a single
+// transaction so that a failure leaves the recorded version untouched.
+func (db *DB) applyMigration(step MigrationStep) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit.
+
+	if err := step.run(tx); err != nil {
+		return err
+	}
+	migration := step.Migration
+	if step.Direction == migrationUp {
+		insert := tx.Rebind("INSERT INTO " + MigrationsTablename + " (version, filename, checksum) VALUES (?, ?, ?)")
+		if _, err := tx.Exec(insert, migration.Version, migration.Filename, migration.Checksum); err != nil {
+			return err
+		}
+	} else {
+		remove := tx.Rebind("DELETE FROM " + MigrationsTablename + " WHERE version=?")
+		if _, err := tx.Exec(remove, migration.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) tableExists(tableName string) (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = ?"
+	if db.Dialect == DialectSQLite {
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	}
+	var count int
+	err := db.Get(&count, db.Rebind(query), tableName)
+	return count > 0, err
+}
+
+func (db *DB) createMigrationsTable() error {
+	appliedAt := "TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC')"
+	if db.Dialect == DialectSQLite {
+		appliedAt = "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + MigrationsTablename + ` (
+  version    BIGINT PRIMARY KEY,
+  filename   TEXT NOT NULL,
+  checksum   TEXT NOT NULL,
+  applied_at ` + appliedAt + `
+)`)
+	return err
+}
+
+type migrationFile struct {
+	Filename  string
+	Version   int64
+	Name      string
+	Dialect   string
+	Direction string
+}
+
+// Parse a filename like "001_create_users.sqlite.up.sql" into its version,
+// name, optional dialect and direction.
+func parseMigrationFilename(filename string) (migrationFile, error) {
+	file := migrationFile{Filename: filename, Direction: migrationUp}
+	invalid := fmt.Errorf("invalid migration filename %q, expected <version>_<name>[.<dialect>][.up|.down].sql", filename)
+	if !strings.HasSuffix(filename, ".sql") {
+		return file, invalid
+	}
+	base := strings.TrimSuffix(filename, ".sql")
+	if strings.HasSuffix(base, "."+migrationDown) {
+		base, file.Direction = strings.TrimSuffix(base, "."+migrationDown), migrationDown
+	} else {
+		base = strings.TrimSuffix(base, "."+migrationUp)
+	}
+	for _, dialect := range []string{DialectPostgres, DialectSQLite} {
+		if strings.HasSuffix(base, "."+dialect) {
+			base, file.Dialect = strings.TrimSuffix(base, "."+dialect), dialect
+		}
+	}
+
+	prefix, name, ok := strings.Cut(base, "_")
+	if !ok || name == "" || strings.Contains(name, ".") {
+		return file, invalid
+	}
+	version, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil || version <= 0 {
+		return file, fmt.Errorf("invalid migration version in filename %q", filename)
+	}
+	file.Version, file.Name = version, name
+	return file, nil
+}
+
+func hasVersion(migrations []Migration, version int64) bool {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+func checksum(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
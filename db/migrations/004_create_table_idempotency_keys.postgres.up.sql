@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key         TEXT PRIMARY KEY,
+  fingerprint TEXT NOT NULL,
+  status      INTEGER NOT NULL DEFAULT 0, -- Zero while the first request is in progress.
+  headers     TEXT NOT NULL DEFAULT '{}',
+  body        BYTEA NOT NULL DEFAULT '',
+  created_at  TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC')
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
@@ -0,0 +1,3 @@
+-- Fails while a deleted user and another share an email, until one is purged.
+DROP INDEX IF EXISTS users_email_key;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
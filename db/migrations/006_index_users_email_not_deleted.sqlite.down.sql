@@ -0,0 +1,3 @@
+-- Fails while a deleted user and another share an email, until one is purged.
+DROP INDEX IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (email);
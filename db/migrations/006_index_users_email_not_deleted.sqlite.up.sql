@@ -0,0 +1,16 @@
+-- SQLite can't drop the UNIQUE constraint of a column, so rebuild the table.
+CREATE TABLE users_new (
+  id         INTEGER PRIMARY KEY AUTOINCREMENT,
+  email      TEXT NOT NULL CHECK (TRIM(email) != ''),
+  password   TEXT NOT NULL CHECK (TRIM(password) != ''),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  version    INTEGER NOT NULL DEFAULT 1,
+  deleted_at TIMESTAMP
+);
+INSERT INTO users_new (id, email, password, created_at, updated_at, version, deleted_at)
+  SELECT id, email, password, created_at, updated_at, version, deleted_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (email) WHERE deleted_at IS NULL;
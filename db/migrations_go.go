@@ -0,0 +1,42 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A migration written in Go for changes which can't be expressed in plain
+// SQL, e.g. re-hashing passwords or backfilling derived columns. It runs in
+// the same transaction that records the migration version.
+type MigrationFunc func(tx *sqlx.Tx) error
+
+// Go migrations registered by version, not safe for concurrent registration.
+var goMigrations = map[int64]Migration{}
+
+// Register a Go migration to run in version order alongside the embedded SQL
+// files, typically from an init function. The down function may be nil if
+// the migration is irreversible. Panics on an invalid or duplicate version.
+func RegisterMigration(version int64, name string, up, down MigrationFunc) {
+	if version <= 0 {
+		panic(fmt.Errorf("invalid migration version %v for %q", version, name))
+	}
+	if up == nil {
+		panic(fmt.Errorf("missing up function for migration %v %q", version, name))
+	}
+	if other, ok := goMigrations[version]; ok {
+		panic(fmt.Errorf("duplicate migration version %v in %q and %q", version, other.Name, name))
+	}
+
+	migration := Migration{
+		Version:  version,
+		Name:     name,
+		Filename: fmt.Sprintf("%03d_%s.go", version, name),
+		UpFunc:   up,
+		DownFunc: down,
+	}
+	if down != nil {
+		migration.DownFilename = migration.Filename
+	}
+	goMigrations[version] = migration
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/maerics/golog"
+)
+
+// How long Migrate waits for another process to release the migrations lock.
+const DefaultMigrationLockTimeout = 1 * time.Minute
+
+// The table used to serialize migrations on drivers without advisory locks.
+const MigrationsLockTablename = MigrationsTablename + "_lock"
+
+// An arbitrary application specific key for the Postgres advisory lock.
+const migrationsAdvisoryLockKey = 7253164901
+
+const migrationsLockPollInterval = 500 * time.Millisecond
+
+// Run the given function while holding a database wide lock so that exactly
+// one process migrates at a time while any others wait up to the timeout.
+func (db *DB) withMigrationsLock(f func() error) error {
+	timeout := db.MigrationLockTimeout
+	if timeout <= 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	lock, unlock := db.lockMigrationsTable, db.unlockMigrationsTable
+	if db.Dialect == DialectPostgres {
+		// The lock holds a connection of its own until the migrations are
+		// done, so allow one more than max_open_conns meanwhile; otherwise
+		// a pool of one would wait on the lock for a connection to migrate.
+		if max := db.Stats().MaxOpenConnections; max > 0 {
+			db.SetMaxOpenConns(max + 1)
+			defer db.SetMaxOpenConns(max)
+		}
+		conn, err := db.Connx(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// Advisory locks belong to a session so both calls must use the same connection.
+		lock = func(ctx context.Context) (bool, error) {
+			var locked bool
+			err := conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", migrationsAdvisoryLockKey)
+			return locked, err
+		}
+		unlock = func() error {
+			_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsAdvisoryLockKey)
+			return err
+		}
+	} else {
+		if err := db.createMigrationsLockTable(); err != nil {
+			return err
+		}
+	}
+
+	if err := pollMigrationsLock(ctx, timeout, lock); err != nil {
+		return db.staleMigrationsLockHint(err)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Errorf("failed to release migrations lock: %v", err)
+		}
+	}()
+
+	return f()
+}
+
+// Try to acquire the lock until it succeeds or the context is done.
+func pollMigrationsLock(ctx context.Context, timeout time.Duration, lock func(context.Context) (bool, error)) error {
+	waiting := false
+	for {
+		locked, err := lock(ctx)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("acquiring migrations lock: %w", err)
+		}
+		if locked {
+			return nil
+		}
+		if !waiting {
+			log.Printf("waiting up to %v for another process to finish migrating", timeout)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %v waiting for the migrations lock", timeout)
+		case <-time.After(migrationsLockPollInterval):
+		}
+	}
+}
+
+// The lock table holds at most one row, inserted by the lock holder; an
+// insert conflict with the primary key means another process holds it.
+func (db *DB) lockMigrationsTable(ctx context.Context) (bool, error) {
+	insert := "INSERT INTO " + MigrationsLockTablename + " (id, locked_at) VALUES (1, CURRENT_TIMESTAMP)"
+	_, insertErr := db.ExecContext(ctx, insert)
+	if insertErr == nil {
+		return true, nil
+	}
+
+	// Distinguish a held lock from any other failure to insert.
+	var count int
+	query := "SELECT COUNT(*) FROM " + MigrationsLockTablename
+	if err := db.GetContext(ctx, &count, query); err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, insertErr
+	}
+	return false, nil
+}
+
+func (db *DB) unlockMigrationsTable() error {
+	_, err := db.Exec("DELETE FROM " + MigrationsLockTablename)
+	return err
+}
+
+// Explain how to remove the lock left by a migrating process which crashed,
+// since nothing else ever releases the lock table.
+func (db *DB) staleMigrationsLockHint(err error) error {
+	if db.Dialect == DialectPostgres {
+		return err
+	}
+	var lockedAt time.Time
+	query := "SELECT locked_at FROM " + MigrationsLockTablename
+	if db.Get(&lockedAt, query) != nil {
+		return err
+	}
+	return fmt.Errorf("%w, locked since %v; run \"db migrate --force-unlock\" if no other process is migrating",
+		err, lockedAt.Format(time.RFC3339))
+}
+
+// Release the migrations lock held by another process, e.g. one which crashed
+// while migrating. Postgres releases its advisory lock when the session ends,
+// so this only clears the lock table of other drivers.
+func (db *DB) ForceUnlockMigrations() error {
+	if db.Dialect == DialectPostgres {
+		return nil
+	}
+	if err := db.createMigrationsLockTable(); err != nil {
+		return err
+	}
+	return db.unlockMigrationsTable()
+}
+
+func (db *DB) createMigrationsLockTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + MigrationsLockTablename + ` (
+  id        INTEGER PRIMARY KEY,
+  locked_at TIMESTAMP NOT NULL
+)`)
+	return err
+}
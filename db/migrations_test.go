@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMigrationFilename(t *testing.T) {
+	for _, eg := range []struct {
+		filename  string
+		version   int64
+		name      string
+		dialect   string
+		direction string
+		ok        bool
+	}{
+		{"001_create_table_users.sql", 1, "create_table_users", "", "up", true},
+		{"001_create_table_users.up.sql", 1, "create_table_users", "", "up", true},
+		{"001_create_table_users.down.sql", 1, "create_table_users", "", "down", true},
+		{"001_create_table_users.postgres.up.sql", 1, "create_table_users", "postgres", "up", true},
+		{"001_create_table_users.sqlite.down.sql", 1, "create_table_users", "sqlite", "down", true},
+		{"001_create_table_users.sqlite.sql", 1, "create_table_users", "sqlite", "up", true},
+		{"042_add_column.sql", 42, "add_column", "", "up", true},
+		{"20240101120000_timestamped.sql", 20240101120000, "timestamped", "", "up", true},
+		{"create_table_users.sql", 0, "", "", "", false},
+		{"000_zero.sql", 0, "", "", "", false},
+		{"001_not_sql.txt", 0, "", "", "", false},
+		{"001.sql", 0, "", "", "", false},
+		{"001_.down.sql", 0, "", "", "", false},
+		{"001_x.mysql.up.sql", 0, "", "", "", false},
+	} {
+		file, err := parseMigrationFilename(eg.filename)
+		assert.Equal(t, eg.ok, err == nil, eg.filename)
+		if eg.ok {
+			assert.Equal(t, eg.version, file.Version, eg.filename)
+			assert.Equal(t, eg.name, file.Name, eg.filename)
+			assert.Equal(t, eg.dialect, file.Dialect, eg.filename)
+			assert.Equal(t, eg.direction, file.Direction, eg.filename)
+		}
+	}
+}
+
+func TestLoadMigrationsSortedByVersion(t *testing.T) {
+	for _, dialect := range []string{DialectPostgres, DialectSQLite} {
+		migrations, err := LoadMigrations(dialect)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, migrations)
+		for i := 1; i < len(migrations); i++ {
+			assert.Less(t, migrations[i-1].Version, migrations[i].Version)
+		}
+		for _, migration := range migrations {
+			file, err := parseMigrationFilename(migration.Filename)
+			if !migration.IsGo() {
+				assert.NoError(t, err)
+				assert.Contains(t, []string{"", dialect}, file.Dialect)
+			}
+		}
+	}
+}
+
+func TestMigrateRecordsAppliedVersions(t *testing.T) {
+	testdb := MustConnectTestDB()
+	if err := testdb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testdb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := LoadMigrations(testdb.Dialect)
+	assert.NoError(t, err)
+	applied, err := testdb.AppliedMigrations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+	for i, migration := range migrations {
+		assert.Equal(t, migration.Version, applied[i].Version)
+		assert.Equal(t, migration.Checksum, applied[i].Checksum)
+		assert.NotNil(t, applied[i].AppliedAt)
+	}
+}
+
+func TestRollbackAndMigrateTo(t *testing.T) {
+	testdb := MustConnectTestDB()
+	if err := testdb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := LoadMigrations(testdb.Dialect)
+	assert.NoError(t, err)
+	latest := migrations[len(migrations)-1]
+
+	if err := testdb.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := testdb.AppliedMigrations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations)-1, len(applied))
+
+	if err := testdb.MigrateTo(latest.Version); err != nil {
+		t.Fatal(err)
+	}
+	applied, err = testdb.AppliedMigrations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+	assert.Equal(t, latest.Version, applied[len(applied)-1].Version)
+
+	assert.Error(t, testdb.MigrateTo(latest.Version+1))
+}
+
+func TestMigrationStatusesAndPlan(t *testing.T) {
+	testdb := MustConnectTestDB()
+	if err := testdb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := testdb.MigrationStatuses()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.Equal(t, MigrationApplied, status.State, status.Filename)
+	}
+
+	steps, err := testdb.PlanMigrateTo(0)
+	assert.NoError(t, err)
+	assert.Empty(t, steps)
+
+	steps, err = testdb.PlanRollback(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(steps))
+	assert.Equal(t, statuses[len(statuses)-1].Version, steps[0].Migration.Version)
+	assert.NotEmpty(t, steps[0].Query())
+}
+
+// Reporting the migrations of a new database never writes to it.
+func TestMigrationStatusesReadOnly(t *testing.T) {
+	freshdb, err := Connect("sqlite3://" + filepath.Join(t.TempDir(), "fresh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freshdb.Close()
+
+	statuses, err := freshdb.MigrationStatuses()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.Equal(t, MigrationPending, status.State, status.Filename)
+	}
+	steps, err := freshdb.PlanMigrateTo(0)
+	assert.NoError(t, err)
+	assert.Len(t, steps, len(statuses))
+	exists, err := freshdb.tableExists(MigrationsTablename)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, freshdb.Migrate())
+	exists, err = freshdb.tableExists(MigrationsTablename)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestConcurrentMigrate(t *testing.T) {
+	testdbs := []*DB{MustConnectTestDB(), MustConnectTestDB(), MustConnectTestDB()}
+	errs := make(chan error, len(testdbs))
+	for _, testdb := range testdbs {
+		go func(testdb *DB) { errs <- testdb.Migrate() }(testdb)
+	}
+	for range testdbs {
+		assert.NoError(t, <-errs)
+	}
+
+	migrations, err := LoadMigrations(testdbs[0].Dialect)
+	assert.NoError(t, err)
+	applied, err := testdbs[0].AppliedMigrations()
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+}
+
+// Postgres migrations hold a connection for the lock besides the ones they
+// run on, which must not deadlock a pool of one.
+func TestMigrateWithOneConnection(t *testing.T) {
+	testdb := MustConnectTestDB()
+	testdb.SetMaxOpenConns(1)
+	testdb.MigrationLockTimeout = 5 * time.Second
+	assert.NoError(t, testdb.Rollback(1))
+	assert.NoError(t, testdb.Migrate())
+	assert.Equal(t, 1, testdb.Stats().MaxOpenConnections)
+}
+
+func TestForceUnlockMigrations(t *testing.T) {
+	testdb := MustConnectTestDB()
+	if testdb.Dialect == DialectPostgres {
+		t.Skip("Postgres advisory locks are released with their session")
+	}
+	if err := testdb.createMigrationsLockTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer testdb.unlockMigrationsTable()
+
+	// The lock of a migrating process which crashed is never released.
+	locked, err := testdb.lockMigrationsTable(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	testdb.MigrationLockTimeout = time.Second
+	err = testdb.Migrate()
+	assert.ErrorContains(t, err, "timed out")
+	assert.ErrorContains(t, err, "--force-unlock")
+
+	assert.NoError(t, testdb.ForceUnlockMigrations())
+	assert.NoError(t, testdb.Migrate())
+}
+
+func TestGoMigrations(t *testing.T) {
+	const version = 999999
+	calls := []string{}
+	RegisterMigration(version, "test_go_migration",
+		func(tx *sqlx.Tx) error {
+			calls = append(calls, "up")
+			var one int
+			return tx.Get(&one, "SELECT 1")
+		},
+		func(tx *sqlx.Tx) error {
+			calls = append(calls, "down")
+			return nil
+		})
+	defer delete(goMigrations, version)
+	assert.Panics(t, func() { RegisterMigration(version, "duplicate", func(*sqlx.Tx) error { return nil }, nil) })
+
+	testdb := MustConnectTestDB()
+	migrations, err := LoadMigrations(testdb.Dialect)
+	assert.NoError(t, err)
+	latest := migrations[len(migrations)-1]
+	assert.Equal(t, int64(version), latest.Version)
+	assert.Equal(t, "999999_test_go_migration.go", latest.Filename)
+	assert.True(t, latest.IsGo())
+	assert.True(t, latest.Reversible())
+
+	if err := testdb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testdb.RollbackTo(version - 1); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"up", "down"}, calls)
+}
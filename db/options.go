@@ -0,0 +1,123 @@
+package db
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used when the database URL omits the corresponding
+// query parameter, e.g. "postgres://host/db?max_open_conns=10".
+const (
+	Env_DATABASE_MAX_OPEN_CONNS       = "DATABASE_MAX_OPEN_CONNS"       // max_open_conns
+	Env_DATABASE_MAX_IDLE_CONNS       = "DATABASE_MAX_IDLE_CONNS"       // max_idle_conns
+	Env_DATABASE_CONN_MAX_LIFETIME    = "DATABASE_CONN_MAX_LIFETIME"    // conn_max_lifetime
+	Env_DATABASE_CONN_MAX_IDLE_TIME   = "DATABASE_CONN_MAX_IDLE_TIME"   // conn_max_idle_time
+	Env_DATABASE_CONNECT_ATTEMPTS     = "DATABASE_CONNECT_ATTEMPTS"     // connect_attempts
+	Env_DATABASE_MAX_REPLICA_LAG      = "DATABASE_MAX_REPLICA_LAG"      // max_replica_lag
+	Env_DATABASE_SLOW_QUERY_THRESHOLD = "DATABASE_SLOW_QUERY_THRESHOLD" // slow_query_threshold
+	Env_DATABASE_QUERY_TIMEOUT        = "DATABASE_QUERY_TIMEOUT"        // query_timeout
+)
+
+// Connection pool and startup settings. The zero durations and max open
+// connections mean unlimited, as for database/sql.
+type Options struct {
+	MaxOpenConns    int           `json:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time"`
+	ConnectAttempts int           `json:"connect_attempts"`
+	MaxReplicaLag   time.Duration `json:"max_replica_lag"` // Only for read replicas, zero to ignore lag.
+
+	SlowQueryThreshold time.Duration `json:"slow_query_threshold"` // Zero to disable the slow query log.
+	QueryTimeout       time.Duration `json:"query_timeout"`        // Zero to let queries run until their context ends.
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxIdleConns:    2, // The database/sql default.
+		ConnectAttempts: 6, // About 15s total with the backoff below.
+		MaxReplicaLag:   10 * time.Second,
+
+		SlowQueryThreshold: 200 * time.Millisecond,
+		QueryTimeout:       30 * time.Second,
+	}
+}
+
+const (
+	connectRetryInitialDelay = 500 * time.Millisecond
+	connectRetryMaxDelay     = 8 * time.Second
+)
+
+type option struct {
+	param, env string
+	parse      func(*Options, string) error
+}
+
+var options = []option{
+	{"max_open_conns", Env_DATABASE_MAX_OPEN_CONNS, intOption(func(o *Options) *int { return &o.MaxOpenConns })},
+	{"max_idle_conns", Env_DATABASE_MAX_IDLE_CONNS, intOption(func(o *Options) *int { return &o.MaxIdleConns })},
+	{"conn_max_lifetime", Env_DATABASE_CONN_MAX_LIFETIME, durationOption(func(o *Options) *time.Duration { return &o.ConnMaxLifetime })},
+	{"conn_max_idle_time", Env_DATABASE_CONN_MAX_IDLE_TIME, durationOption(func(o *Options) *time.Duration { return &o.ConnMaxIdleTime })},
+	{"connect_attempts", Env_DATABASE_CONNECT_ATTEMPTS, intOption(func(o *Options) *int { return &o.ConnectAttempts })},
+	{"max_replica_lag", Env_DATABASE_MAX_REPLICA_LAG, durationOption(func(o *Options) *time.Duration { return &o.MaxReplicaLag })},
+	{"slow_query_threshold", Env_DATABASE_SLOW_QUERY_THRESHOLD, durationOption(func(o *Options) *time.Duration { return &o.SlowQueryThreshold })},
+	{"query_timeout", Env_DATABASE_QUERY_TIMEOUT, durationOption(func(o *Options) *time.Duration { return &o.QueryTimeout })},
+}
+
+// Read the options from the URL query parameters, falling back to the
+// environment, and remove them from the URL so the driver never sees them.
+func parseOptions(u *url.URL) (Options, error) {
+	opts := DefaultOptions()
+	query := u.Query()
+	for _, option := range options {
+		value, source := query.Get(option.param), option.param
+		if query.Has(option.param) {
+			query.Del(option.param)
+		} else {
+			value, source = strings.TrimSpace(os.Getenv(option.env)), option.env
+		}
+		if value == "" {
+			continue
+		}
+		if err := option.parse(&opts, value); err != nil {
+			return opts, fmt.Errorf("invalid database option %v=%q: %w", source, value, err)
+		}
+	}
+	u.RawQuery = query.Encode()
+	if opts.ConnectAttempts < 1 {
+		opts.ConnectAttempts = 1
+	}
+	return opts, nil
+}
+
+func intOption(field func(*Options) *int) func(*Options, string) error {
+	return func(o *Options, s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*field(o) = n
+		return nil
+	}
+}
+
+func durationOption(field func(*Options) *time.Duration) func(*Options, string) error {
+	return func(o *Options, s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		*field(o) = d
+		return nil
+	}
+}
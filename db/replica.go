@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/maerics/golog"
+)
+
+// How often the replica health is re-checked and how long a check may take.
+var (
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 1 * time.Second
+)
+
+// Postgres replication lag in seconds, zero when fully replayed or when
+// connected to a primary rather than a standby.
+const postgresReplicaLagQuery = `SELECT COALESCE(
+  CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+       ELSE EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp())
+  END, 0)`
+
+type replica struct {
+	db     *DB
+	maxLag time.Duration
+
+	healthy   atomic.Bool
+	checking  atomic.Bool
+	checkedAt atomic.Int64 // Unix nanoseconds.
+}
+
+// Connect a read replica which Reader returns for read-only queries while
+// it is reachable and its replication lag is within the "max_replica_lag"
+// option of its URL. A replica which is down starts out unhealthy rather
+// than failing, until a health check reaches it.
+func (db *DB) ConnectReplica(replicaURL string) error {
+	replicadb, opts, err := connect(replicaURL, true)
+	if err != nil {
+		return fmt.Errorf("connecting to read replica: %w", err)
+	}
+	if replicadb.Dialect != db.Dialect {
+		replicadb.Close()
+		return fmt.Errorf("read replica dialect %q does not match primary %q", replicadb.Dialect, db.Dialect)
+	}
+
+	replicadb.stats = db.stats
+	db.replica = &replica{db: replicadb, maxLag: opts.MaxReplicaLag}
+	db.replica.refresh()
+	return nil
+}
+
+// Return the read replica for read-only queries if one is connected and
+// healthy, otherwise the primary.
+func (db *DB) Reader() *DB {
+	if db.replica == nil {
+		return db
+	}
+	if db.replica.isHealthy() {
+		return db.replica.db
+	}
+	return db
+}
+
+// Report the last known health and refresh it in the background once stale
+// so that callers never wait on the check.
+func (r *replica) isHealthy() bool {
+	stale := time.Since(time.Unix(0, r.checkedAt.Load())) > replicaCheckInterval
+	if stale && r.checking.CompareAndSwap(false, true) {
+		go func() {
+			defer r.checking.Store(false)
+			r.refresh()
+		}()
+	}
+	return r.healthy.Load()
+}
+
+func (r *replica) refresh() {
+	err := r.check()
+	healthy := err == nil
+	if was := r.healthy.Swap(healthy); was != healthy || r.checkedAt.Load() == 0 {
+		if healthy {
+			log.Printf("read replica is healthy, routing reads to it")
+		} else {
+			log.Errorf("read replica is unhealthy, routing reads to the primary: %v", err)
+		}
+	}
+	r.checkedAt.Store(time.Now().UnixNano())
+}
+
+func (r *replica) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+
+	if err := r.db.PingContext(ctx); err != nil {
+		return err
+	}
+	if r.db.Dialect != DialectPostgres || r.maxLag <= 0 {
+		return nil
+	}
+	var lagSeconds float64
+	if err := r.db.GetContext(ctx, &lagSeconds, postgresReplicaLagQuery); err != nil {
+		return err
+	}
+	if lag := time.Duration(lagSeconds * float64(time.Second)); lag > r.maxLag {
+		return fmt.Errorf("replication lag %v exceeds %v", lag.Round(time.Millisecond), r.maxLag)
+	}
+	return nil
+}
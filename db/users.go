@@ -0,0 +1,427 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"webapp/models"
+)
+
+// Storage for users. Lookups of missing users return sql.ErrNoRows and
+// passwords are stored as given, so callers hash them first.
+//
+// Writes given a nonzero version only apply to the user at that version,
+// returning ErrVersionMismatch otherwise, and each update increments it.
+//
+// Deleting a user only sets its deleted_at, until it is restored or purged,
+// and other methods treat deleted users as missing unless they say otherwise.
+type UserRepository interface {
+	Create(ctx context.Context, user models.User) (models.User, error)
+	Get(ctx context.Context, id int) (models.User, error)
+	GetIncludingDeleted(ctx context.Context, id int) (models.User, error)
+	GetByEmail(ctx context.Context, email string) (models.User, error)
+	List(ctx context.Context, opts UserListOptions) (UserPage, error)
+	Update(ctx context.Context, user models.User) (models.User, error)
+	Patch(ctx context.Context, id int, patch UserPatch) (models.User, error)
+	Delete(ctx context.Context, id, version int) error
+	// Undelete a user, returning it as is unless it is deleted.
+	Restore(ctx context.Context, id, version int) (models.User, error)
+	// Permanently remove the users deleted before the given time.
+	Purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// The fields of a user to change, leaving nil ones as they are.
+type UserPatch struct {
+	Email    *string
+	Password *string
+	Version  int // The expected version, any if zero.
+}
+
+func (p UserPatch) isEmpty() bool {
+	return p.Email == nil && p.Password == nil
+}
+
+const userColumns = "id, email, password, created_at, updated_at, version, deleted_at"
+
+type sqlUserRepository struct {
+	db *DB
+}
+
+// Store users in the "users" table, listing and getting them by id from the
+// read replica.
+func NewUserRepository(db *DB) UserRepository {
+	return &sqlUserRepository{db}
+}
+
+func (r *sqlUserRepository) Create(ctx context.Context, user models.User) (models.User, error) {
+	var created models.User
+	query := r.db.Rebind("INSERT INTO users (email, password) VALUES (?, ?) RETURNING " + userColumns)
+	err := r.db.GetContext(ctx, &created, query, user.Email, user.Password)
+	return created, err
+}
+
+func (r *sqlUserRepository) Get(ctx context.Context, id int) (models.User, error) {
+	var user models.User
+	query := r.db.Rebind("SELECT " + userColumns + " FROM users WHERE id = ? AND deleted_at IS NULL")
+	err := r.db.Reader().GetContext(ctx, &user, query, id)
+	return user, err
+}
+
+func (r *sqlUserRepository) GetIncludingDeleted(ctx context.Context, id int) (models.User, error) {
+	var user models.User
+	query := r.db.Rebind("SELECT " + userColumns + " FROM users WHERE id = ?")
+	err := r.db.Reader().GetContext(ctx, &user, query, id)
+	return user, err
+}
+
+// Always read from the primary so a user can log in right after signing up.
+func (r *sqlUserRepository) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	var user models.User
+	query := r.db.Rebind("SELECT " + userColumns + " FROM users WHERE email = ? AND deleted_at IS NULL")
+	err := r.db.GetContext(ctx, &user, query, email)
+	return user, err
+}
+
+// List a page of users by keyset pagination, so later pages are as fast as
+// the first given an index on the sort field.
+func (r *sqlUserRepository) List(ctx context.Context, opts UserListOptions) (UserPage, error) {
+	order, err := opts.order()
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	where, args := []string{"1 = 1"}, []any{}
+	if !opts.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if opts.EmailContains != "" {
+		where = append(where, `LOWER(email) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(opts.EmailContains))+"%")
+	}
+	if opts.CreatedAfter != nil {
+		where = append(where, "created_at > ?")
+		args = append(args, r.db.TimeArg(*opts.CreatedAfter))
+	}
+	op, dir := ">", "ASC"
+	if order.desc {
+		op, dir = "<", "DESC"
+	}
+	if after := order.after; after != nil {
+		switch order.field {
+		case "id":
+			where = append(where, "id "+op+" ?")
+			args = append(args, after.Id)
+		case "email":
+			where = append(where, "(email "+op+" ? OR (email = ? AND id "+op+" ?))")
+			args = append(args, after.Value, after.Value, after.Id)
+		case "created_at":
+			t := r.db.TimeArg(*after.user().CreatedAt)
+			where = append(where, "(created_at "+op+" ? OR (created_at = ? AND id "+op+" ?))")
+			args = append(args, t, t, after.Id)
+		}
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + order.field + " " + dir
+	if order.field != "id" {
+		query += ", id " + dir
+	}
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	users := []models.User{}
+	err = r.db.Reader().SelectContext(ctx, &users, r.db.Rebind(query), args...)
+	return order.page(users, opts.Limit), err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *sqlUserRepository) Update(ctx context.Context, user models.User) (models.User, error) {
+	var updated models.User
+	where, args := versionedWhere(user.Id, user.Version, false)
+	query := r.db.Rebind("UPDATE users SET email = ?, password = ?, version = version + 1, updated_at = ? WHERE " + where + " RETURNING " + userColumns)
+	err := r.db.GetContext(ctx, &updated, query, append([]any{user.Email, user.Password, r.now()}, args...)...)
+	return updated, r.versionMismatch(ctx, user.Id, user.Version, false, err)
+}
+
+// Update only the given fields, and updated_at unless there are none.
+func (r *sqlUserRepository) Patch(ctx context.Context, id int, patch UserPatch) (models.User, error) {
+	if patch.isEmpty() {
+		var user models.User
+		where, args := versionedWhere(id, patch.Version, false)
+		err := r.db.GetContext(ctx, &user, r.db.Rebind("SELECT "+userColumns+" FROM users WHERE "+where), args...)
+		return user, r.versionMismatch(ctx, id, patch.Version, false, err)
+	}
+	var patched models.User
+	where, args := versionedWhere(id, patch.Version, false)
+	query := r.db.Rebind("UPDATE users SET email = COALESCE(?, email), password = COALESCE(?, password), version = version + 1, updated_at = ? WHERE " + where + " RETURNING " + userColumns)
+	err := r.db.GetContext(ctx, &patched, query, append([]any{patch.Email, patch.Password, r.now()}, args...)...)
+	return patched, r.versionMismatch(ctx, id, patch.Version, false, err)
+}
+
+func (r *sqlUserRepository) Delete(ctx context.Context, id, version int) error {
+	where, args := versionedWhere(id, version, false)
+	now := r.now()
+	query := r.db.Rebind("UPDATE users SET deleted_at = ?, version = version + 1, updated_at = ? WHERE " + where)
+	result, err := r.db.ExecContext(ctx, query, append([]any{now, now}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return r.versionMismatch(ctx, id, version, false, sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (r *sqlUserRepository) Restore(ctx context.Context, id, version int) (models.User, error) {
+	var restored models.User
+	where, args := versionedWhere(id, version, true)
+	query := r.db.Rebind("UPDATE users SET deleted_at = NULL, version = version + 1, updated_at = ? WHERE " + where + " RETURNING " + userColumns)
+	err := r.db.GetContext(ctx, &restored, query, append([]any{r.now()}, args...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		where, args := versionedWhere(id, version, false)
+		err = r.db.GetContext(ctx, &restored, r.db.Rebind("SELECT "+userColumns+" FROM users WHERE "+where), args...)
+		err = r.versionMismatch(ctx, id, version, true, err)
+	}
+	return restored, err
+}
+
+func (r *sqlUserRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	query := r.db.Rebind("DELETE FROM users WHERE deleted_at < ?")
+	result, err := r.db.ExecContext(ctx, query, r.db.TimeArg(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// The current time for timestamp columns, in UTC like their defaults rather
+// than the session time zone of CURRENT_TIMESTAMP on Postgres.
+func (r *sqlUserRepository) now() any {
+	return r.db.TimeArg(time.Now())
+}
+
+// The condition for a deleted or live user by id, and by version unless it
+// is zero.
+func versionedWhere(id, version int, deleted bool) (string, []any) {
+	where, args := "id = ? AND deleted_at IS NULL", []any{id}
+	if deleted {
+		where = "id = ? AND deleted_at IS NOT NULL"
+	}
+	if version != 0 {
+		where, args = where+" AND version = ?", append(args, version)
+	}
+	return where, args
+}
+
+// The error of a conditional write which found no rows, ErrVersionMismatch
+// if the user exists at another version.
+func (r *sqlUserRepository) versionMismatch(ctx context.Context, id, version int, includeDeleted bool, err error) error {
+	if version == 0 || !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	var exists bool
+	where := "id = ? AND deleted_at IS NULL"
+	if includeDeleted {
+		where = "id = ?"
+	}
+	query := r.db.Rebind("SELECT EXISTS (SELECT 1 FROM users WHERE " + where + ")")
+	if err := r.db.GetContext(ctx, &exists, query, id); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return sql.ErrNoRows
+}
+
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int]models.User
+	lastId int
+}
+
+// Store users in memory, e.g. for tests, with the same constraints as the
+// "users" table.
+func NewMemoryUserRepository() UserRepository {
+	return &memoryUserRepository{users: map[int]models.User{}}
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user models.User) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.check(user); err != nil {
+		return models.User{}, err
+	}
+	r.lastId++
+	now := time.Now().UTC()
+	user.Id, user.CreatedAt, user.UpdatedAt, user.Version = r.lastId, &now, &now, 1
+	r.users[user.Id] = user
+	return user, nil
+}
+
+func (r *memoryUserRepository) Get(ctx context.Context, id int) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.get(id, 0, false)
+}
+
+func (r *memoryUserRepository) GetIncludingDeleted(ctx context.Context, id int) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.get(id, 0, true)
+}
+
+func (r *memoryUserRepository) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email == email && user.DeletedAt == nil {
+			return user, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (r *memoryUserRepository) List(ctx context.Context, opts UserListOptions) (UserPage, error) {
+	order, err := opts.order()
+	if err != nil {
+		return UserPage{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	users := []models.User{}
+	for _, user := range r.users {
+		switch {
+		case !opts.IncludeDeleted && user.DeletedAt != nil:
+		case opts.EmailContains != "" && !strings.Contains(strings.ToLower(user.Email), strings.ToLower(opts.EmailContains)):
+		case opts.CreatedAfter != nil && !user.CreatedAt.After(*opts.CreatedAfter):
+		case order.after != nil && !order.less(order.after.user(), user):
+		default:
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return order.less(users[i], users[j]) })
+	if opts.Limit > 0 && len(users) > opts.Limit+1 {
+		users = users[:opts.Limit+1]
+	}
+	return order.page(users, opts.Limit), nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, user models.User) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, err := r.get(user.Id, user.Version, false)
+	if err != nil {
+		return models.User{}, err
+	}
+	if err := r.check(user); err != nil {
+		return models.User{}, err
+	}
+	now := time.Now().UTC()
+	existing.Email, existing.Password, existing.UpdatedAt = user.Email, user.Password, &now
+	existing.Version++
+	r.users[user.Id] = existing
+	return existing, nil
+}
+
+func (r *memoryUserRepository) Patch(ctx context.Context, id int, patch UserPatch) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.get(id, patch.Version, false)
+	if err != nil || patch.isEmpty() {
+		return user, err
+	}
+	if patch.Email != nil {
+		user.Email = *patch.Email
+	}
+	if patch.Password != nil {
+		user.Password = *patch.Password
+	}
+	if err := r.check(user); err != nil {
+		return models.User{}, err
+	}
+	now := time.Now().UTC()
+	user.UpdatedAt = &now
+	user.Version++
+	r.users[id] = user
+	return user, nil
+}
+
+func (r *memoryUserRepository) Delete(ctx context.Context, id, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.get(id, version, false)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	user.DeletedAt, user.UpdatedAt = &now, &now
+	user.Version++
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepository) Restore(ctx context.Context, id, version int) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.get(id, version, true)
+	if err != nil || user.DeletedAt == nil {
+		return user, err
+	}
+	user.DeletedAt = nil
+	if err := r.check(user); err != nil {
+		return models.User{}, err
+	}
+	now := time.Now().UTC()
+	user.UpdatedAt = &now
+	user.Version++
+	r.users[id] = user
+	return user, nil
+}
+
+func (r *memoryUserRepository) Purge(ctx context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := int64(0)
+	for id, user := range r.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			delete(r.users, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// The user by id, at the version unless it is zero, and treating deleted
+// users as missing unless included. The caller holds the lock.
+func (r *memoryUserRepository) get(id, version int, includeDeleted bool) (models.User, error) {
+	user, ok := r.users[id]
+	switch {
+	case !ok || (user.DeletedAt != nil && !includeDeleted):
+		return models.User{}, sql.ErrNoRows
+	case version != 0 && user.Version != version:
+		return models.User{}, ErrVersionMismatch
+	}
+	return user, nil
+}
+
+// Mirror the "users" table constraints, where only users which aren't
+// deleted have unique emails. The caller holds the lock.
+func (r *memoryUserRepository) check(user models.User) error {
+	if strings.TrimSpace(user.Email) == "" || strings.TrimSpace(user.Password) == "" {
+		return errors.New("email and password must not be blank")
+	}
+	for _, other := range r.users {
+		if other.Email == user.Email && other.Id != user.Id && other.DeletedAt == nil && user.DeletedAt == nil {
+			return fmt.Errorf("%w: email %q is already taken", ErrUniqueViolation, user.Email)
+		}
+	}
+	return nil
+}
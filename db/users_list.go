@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"webapp/models"
+)
+
+// Returned for an unknown sort field, a bad cursor, or a negative limit.
+var ErrInvalidListOptions = errors.New("invalid list options")
+
+// The fields users can be sorted by, descending with a "-" prefix. Ties are
+// broken by id in the same direction.
+var UserSortFields = []string{"id", "email", "created_at"}
+
+// A page of users after the cursor of the previous page, e.g. the first
+// 50 users with "example.com" in their email sorted newest first is
+//
+//	UserListOptions{Limit: 50, Sort: "-created_at", EmailContains: "example.com"}
+type UserListOptions struct {
+	Limit         int    // All users if zero.
+	After         string // The Next cursor of the previous page, if any.
+	Sort          string // Defaults to "id".
+	EmailContains string // Case insensitive.
+	CreatedAfter  *time.Time
+
+	IncludeDeleted bool
+}
+
+type UserPage struct {
+	Users []models.User
+	Next  string // The cursor after the last user, empty on the last page.
+}
+
+// The position of a user in a sorted list, opaque to clients.
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	Id    int    `json:"i"`
+}
+
+// The sort field, direction, and decoded cursor of the options.
+type userListOrder struct {
+	field string
+	desc  bool
+	after *userCursor
+}
+
+func (opts UserListOptions) order() (userListOrder, error) {
+	sort := opts.Sort
+	if sort == "" {
+		sort = "id"
+	}
+	order := userListOrder{field: strings.TrimPrefix(sort, "-"), desc: strings.HasPrefix(sort, "-")}
+
+	valid := false
+	for _, field := range UserSortFields {
+		valid = valid || field == order.field
+	}
+	switch {
+	case !valid:
+		return order, fmt.Errorf("%w: sort must be one of %v, optionally prefixed with \"-\"", ErrInvalidListOptions, UserSortFields)
+	case opts.Limit < 0:
+		return order, fmt.Errorf("%w: limit must not be negative", ErrInvalidListOptions)
+	case opts.After == "":
+		return order, nil
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(opts.After)
+	if err == nil {
+		order.after = &userCursor{}
+		err = json.Unmarshal(bs, order.after)
+	}
+	if err == nil && order.after.Sort != sort {
+		err = fmt.Errorf("cursor is for sort %q", order.after.Sort)
+	}
+	if err == nil && order.field == "created_at" {
+		_, err = time.Parse(time.RFC3339Nano, order.after.Value)
+	}
+	if err != nil {
+		return order, fmt.Errorf("%w: invalid cursor: %v", ErrInvalidListOptions, err)
+	}
+	return order, nil
+}
+
+// The sort field's value of a user, as stored in cursors.
+func (order userListOrder) value(user models.User) string {
+	switch order.field {
+	case "email":
+		return user.Email
+	case "created_at":
+		if user.CreatedAt != nil {
+			return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return ""
+}
+
+func (order userListOrder) cursor(user models.User) string {
+	sort := order.field
+	if order.desc {
+		sort = "-" + sort
+	}
+	bs, _ := json.Marshal(userCursor{sort, order.value(user), user.Id})
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// Whether a user sorts before another.
+func (order userListOrder) less(a, b models.User) bool {
+	cmp := 0
+	switch order.field {
+	case "email":
+		cmp = strings.Compare(a.Email, b.Email)
+	case "created_at":
+		switch {
+		case a.CreatedAt.Before(*b.CreatedAt):
+			cmp = -1
+		case a.CreatedAt.After(*b.CreatedAt):
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		cmp = a.Id - b.Id
+	}
+	if order.desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// The user at the cursor position, with only its id and sort field.
+func (c userCursor) user() models.User {
+	user := models.User{Id: c.Id, Email: c.Value}
+	if t, err := time.Parse(time.RFC3339Nano, c.Value); err == nil {
+		user.CreatedAt = &t
+	}
+	return user
+}
+
+// The page of users after trimming one more than the limit, used to tell
+// whether there is a next page.
+func (order userListOrder) page(users []models.User, limit int) UserPage {
+	if limit > 0 && len(users) > limit {
+		return UserPage{users[:limit], order.cursor(users[limit-1])}
+	}
+	return UserPage{Users: users}
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+	"webapp/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserRepositories(t *testing.T) {
+	testdb := MustConnectTestDB()
+	assert.NoError(t, testdb.Migrate())
+	_, err := testdb.Exec("DELETE FROM users")
+	assert.NoError(t, err)
+
+	for name, repo := range map[string]UserRepository{
+		"sql":    NewUserRepository(testdb),
+		"memory": NewMemoryUserRepository(),
+	} {
+		t.Run(name, func(t *testing.T) { testUserRepository(t, repo) })
+	}
+}
+
+// Timestamps are written in UTC, like the column defaults, even when the
+// Postgres session is in another time zone.
+func TestUserRepositoryTimestampsInUTC(t *testing.T) {
+	testdb := MustConnectTestDB()
+	assert.NoError(t, testdb.Migrate())
+	_, err := testdb.Exec("DELETE FROM users")
+	assert.NoError(t, err)
+	if testdb.Dialect == DialectPostgres {
+		// Keep the single connection, and so its session, for the whole test.
+		testdb.SetMaxOpenConns(1)
+		testdb.SetMaxIdleConns(1)
+		testdb.SetConnMaxLifetime(0)
+		testdb.SetConnMaxIdleTime(0)
+		_, err := testdb.Exec("SET TIME ZONE 'Pacific/Kiritimati'") // UTC+14
+		assert.NoError(t, err)
+	}
+	repo := NewUserRepository(testdb)
+	ctx := context.Background()
+
+	user, err := repo.Create(ctx, models.User{Email: "alice@example.com", Password: "hash1"})
+	assert.NoError(t, err)
+	updated, err := repo.Update(ctx, models.User{Id: user.Id, Email: user.Email, Password: "hash2"})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), *updated.UpdatedAt, time.Minute)
+	assert.False(t, updated.UpdatedAt.Before(*user.CreatedAt))
+	password := "hash3"
+	patched, err := repo.Patch(ctx, user.Id, UserPatch{Password: &password})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), *patched.UpdatedAt, time.Minute)
+	assert.False(t, patched.UpdatedAt.Before(*updated.UpdatedAt))
+
+	// Purging compares deleted_at with UTC times.
+	assert.NoError(t, repo.Delete(ctx, user.Id, 0))
+	deleted, err := repo.GetIncludingDeleted(ctx, user.Id)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), *deleted.DeletedAt, time.Minute)
+	assert.Equal(t, *deleted.DeletedAt, *deleted.UpdatedAt)
+	n, err := repo.Purge(ctx, time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	restored, err := repo.Restore(ctx, user.Id, 0)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), *restored.UpdatedAt, time.Minute)
+	assert.NoError(t, repo.Delete(ctx, user.Id, 0))
+	n, err = repo.Purge(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func testUserRepository(t *testing.T, repo UserRepository) {
+	ctx := context.Background()
+
+	alice, err := repo.Create(ctx, models.User{Email: "alice@example.com", Password: "hash1"})
+	assert.NoError(t, err)
+	assert.Less(t, 0, alice.Id)
+	assert.Equal(t, "alice@example.com", alice.Email)
+	assert.Equal(t, "hash1", alice.Password)
+	assert.NotNil(t, alice.CreatedAt)
+	assert.Equal(t, alice.CreatedAt, alice.UpdatedAt)
+	assert.Equal(t, 1, alice.Version)
+
+	_, err = repo.Create(ctx, models.User{Email: "alice@example.com", Password: "hash2"})
+	assert.True(t, IsUniqueViolation(err), "duplicate email: %v", err)
+	_, err = repo.Create(ctx, models.User{Email: " ", Password: "hash2"})
+	assert.Error(t, err, "blank email")
+
+	bob, err := repo.Create(ctx, models.User{Email: "bob@example.com", Password: "hash2"})
+	assert.NoError(t, err)
+
+	got, err := repo.Get(ctx, alice.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, got)
+	got, err = repo.GetByEmail(ctx, "bob@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, bob, got)
+	_, err = repo.Get(ctx, bob.Id+1000)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = repo.GetByEmail(ctx, "nobody@example.com")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	page, err := repo.List(ctx, UserListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, UserPage{Users: []models.User{alice, bob}}, page)
+
+	bob.Email = "robert@example.com"
+	updated, err := repo.Update(ctx, bob)
+	assert.NoError(t, err)
+	assert.Equal(t, bob.Id, updated.Id)
+	assert.Equal(t, "robert@example.com", updated.Email)
+	assert.Equal(t, bob.CreatedAt, updated.CreatedAt)
+	assert.Equal(t, bob.Version+1, updated.Version)
+	_, err = repo.Update(ctx, bob)
+	assert.ErrorIs(t, err, ErrVersionMismatch, "stale version")
+	bob.Version = 0
+	bob.Email = "alice@example.com"
+	_, err = repo.Update(ctx, bob)
+	assert.True(t, IsUniqueViolation(err), "duplicate email: %v", err)
+	_, err = repo.Update(ctx, models.User{Id: bob.Id + 1000, Email: "x", Password: "y"})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	password := "hash3"
+	_, err = repo.Patch(ctx, bob.Id, UserPatch{Password: &password, Version: updated.Version - 1})
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	_, err = repo.Patch(ctx, bob.Id, UserPatch{Version: updated.Version - 1})
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	patched, err := repo.Patch(ctx, bob.Id, UserPatch{Password: &password, Version: updated.Version})
+	assert.NoError(t, err)
+	assert.Equal(t, updated.Version+1, patched.Version)
+	assert.Equal(t, "robert@example.com", patched.Email)
+	assert.Equal(t, "hash3", patched.Password)
+	assert.Equal(t, bob.CreatedAt, patched.CreatedAt)
+	unchanged, err := repo.Patch(ctx, bob.Id, UserPatch{})
+	assert.NoError(t, err)
+	assert.Equal(t, patched, unchanged)
+	email := "alice@example.com"
+	_, err = repo.Patch(ctx, bob.Id, UserPatch{Email: &email})
+	assert.True(t, IsUniqueViolation(err), "duplicate email: %v", err)
+	_, err = repo.Patch(ctx, bob.Id+1000, UserPatch{Email: &email})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	updated = patched
+
+	assert.ErrorIs(t, repo.Delete(ctx, alice.Id, alice.Version+1), ErrVersionMismatch)
+	assert.NoError(t, repo.Delete(ctx, alice.Id, alice.Version))
+	assert.ErrorIs(t, repo.Delete(ctx, alice.Id, 0), sql.ErrNoRows)
+	page, err = repo.List(ctx, UserListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{updated}, page.Users)
+
+	// Deleted users are kept until purged, and can be restored.
+	deleted, err := repo.GetIncludingDeleted(ctx, alice.Id)
+	assert.NoError(t, err)
+	assert.NotNil(t, deleted.DeletedAt)
+	assert.Equal(t, alice.Version+1, deleted.Version)
+	_, err = repo.GetByEmail(ctx, alice.Email)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = repo.Patch(ctx, alice.Id, UserPatch{Email: &email})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	page, err = repo.List(ctx, UserListOptions{IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{deleted, updated}, page.Users)
+	_, err = repo.Restore(ctx, alice.Id, alice.Version)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	restored, err := repo.Restore(ctx, alice.Id, deleted.Version)
+	assert.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, deleted.Version+1, restored.Version)
+	again, err := repo.Restore(ctx, alice.Id, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, restored, again)
+	_, err = repo.Restore(ctx, alice.Id+1000, 0)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// Only users which aren't deleted have unique emails.
+	assert.NoError(t, repo.Delete(ctx, alice.Id, 0))
+	alice2, err := repo.Create(ctx, models.User{Email: alice.Email, Password: "hash4"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, alice.Id, alice2.Id)
+	_, err = repo.Restore(ctx, alice.Id, 0)
+	assert.True(t, IsUniqueViolation(err), "duplicate email: %v", err)
+	assert.NoError(t, repo.Delete(ctx, alice2.Id, 0))
+
+	assert.NoError(t, repo.Delete(ctx, updated.Id, 0))
+	n, err := repo.Purge(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n, "within the retention period")
+	n, err = repo.Purge(ctx, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	_, err = repo.GetIncludingDeleted(ctx, alice.Id)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	testUserRepositoryList(t, repo)
+}
+
+func testUserRepositoryList(t *testing.T, repo UserRepository) {
+	ctx := context.Background()
+	var users []models.User
+	for _, email := range []string{"carol@example.com", "dave@example.org", "erin@Example.COM", "frank@example.com", "a_b@example.net"} {
+		user, err := repo.Create(ctx, models.User{Email: email, Password: "hash"})
+		assert.NoError(t, err)
+		users = append(users, user)
+	}
+	carol, dave, erin, frank, ab := users[0], users[1], users[2], users[3], users[4]
+
+	// Page through every sort field, in both directions.
+	for sort, expected := range map[string][]models.User{
+		"id":          {carol, dave, erin, frank, ab},
+		"-id":         {ab, frank, erin, dave, carol},
+		"email":       {ab, carol, dave, erin, frank},
+		"-email":      {frank, erin, dave, carol, ab},
+		"created_at":  {carol, dave, erin, frank, ab}, // Ties broken by id.
+		"-created_at": {ab, frank, erin, dave, carol},
+	} {
+		var got []models.User
+		opts := UserListOptions{Limit: 2, Sort: sort}
+		for pages := 1; ; pages++ {
+			page, err := repo.List(ctx, opts)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, len(page.Users), 2)
+			got = append(got, page.Users...)
+			if page.Next == "" {
+				assert.Equal(t, 3, pages, sort)
+				break
+			}
+			opts.After = page.Next
+		}
+		assert.Equal(t, expected, got, sort)
+	}
+
+	page, err := repo.List(ctx, UserListOptions{EmailContains: "EXAMPLE.COM"})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{carol, erin, frank}, page.Users)
+	page, err = repo.List(ctx, UserListOptions{EmailContains: "_b@"})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{ab}, page.Users, "LIKE wildcards are escaped")
+	page, err = repo.List(ctx, UserListOptions{EmailContains: "a%"})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Users)
+
+	past, future := carol.CreatedAt.Add(-time.Hour), carol.CreatedAt.Add(time.Hour)
+	page, err = repo.List(ctx, UserListOptions{CreatedAfter: &past})
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 5)
+	page, err = repo.List(ctx, UserListOptions{CreatedAfter: &future})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Users)
+
+	first, err := repo.List(ctx, UserListOptions{Limit: 1, Sort: "email"})
+	assert.NoError(t, err)
+	for _, opts := range []UserListOptions{
+		{Sort: "password"},
+		{Limit: -1},
+		{After: "not a cursor"},
+		{After: first.Next, Sort: "-email"},
+	} {
+		_, err := repo.List(ctx, opts)
+		assert.ErrorIs(t, err, ErrInvalidListOptions, opts)
+	}
+}
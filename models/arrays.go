@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/jackc/pgtype"
+)
+
+// Postgres array columns as plain slices, so they marshal to JSON arrays,
+// which are nil for NULL.
+type (
+	StringArray  []string
+	Int64Array   []int64
+	Float64Array []float64
+	BoolArray    []bool
+)
+
+func (a *StringArray) Scan(src any) error {
+	return scanArray(&pgtype.TextArray{}, src, (*[]string)(a))
+}
+
+func (a *Int64Array) Scan(src any) error {
+	return scanArray(&pgtype.Int8Array{}, src, (*[]int64)(a))
+}
+
+func (a *Float64Array) Scan(src any) error {
+	return scanArray(&pgtype.Float8Array{}, src, (*[]float64)(a))
+}
+
+func (a *BoolArray) Scan(src any) error {
+	return scanArray(&pgtype.BoolArray{}, src, (*[]bool)(a))
+}
+
+func (a StringArray) Value() (driver.Value, error) {
+	return arrayValue(&pgtype.TextArray{}, []string(a))
+}
+
+func (a Int64Array) Value() (driver.Value, error) {
+	return arrayValue(&pgtype.Int8Array{}, []int64(a))
+}
+
+func (a Float64Array) Value() (driver.Value, error) {
+	return arrayValue(&pgtype.Float8Array{}, []float64(a))
+}
+
+func (a BoolArray) Value() (driver.Value, error) {
+	return arrayValue(&pgtype.BoolArray{}, []bool(a))
+}
+
+type arrayScanner interface {
+	sql.Scanner
+	AssignTo(dst any) error
+}
+
+func scanArray(array arrayScanner, src any, dst any) error {
+	if err := array.Scan(src); err != nil {
+		return err
+	}
+	return array.AssignTo(dst)
+}
+
+type arrayValuer interface {
+	driver.Valuer
+	Set(src any) error
+}
+
+func arrayValue(array arrayValuer, src any) (driver.Value, error) {
+	if err := array.Set(src); err != nil {
+		return nil, err
+	}
+	return array.Value()
+}
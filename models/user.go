@@ -2,10 +2,16 @@ package models
 
 import "time"
 
+// A row of the "users" table.
+//
+//   - Primary key: id.
+//   - Unique: email.
 type User struct {
 	Id        int        `json:"id" db:"id"`
 	Email     string     `json:"email" db:"email"`
-	Password  string     `json:"password" db:"password"`
+	Password  string     `json:"-" db:"password"` // A bcrypt hash, never serialized.
 	CreatedAt *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
+	Version   int        `json:"version" db:"version"`       // Incremented by every update.
+	DeletedAt *time.Time `json:"deleted_at" db:"deleted_at"` // Soft deleted if not null.
 }
@@ -2,41 +2,132 @@ package web
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"strconv"
+	"time"
+	"webapp/db"
 	"webapp/models"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// The request body for creating a user. Passwords are at most 72 bytes,
+// the limit of bcrypt, which the "password" tag checks.
+type NewUserDTO struct {
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" binding:"required,min=8,max=72,password"`
+}
+
+// The request body for updating a user, replacing its email and password.
+type UpdateUserDTO struct {
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" binding:"required,min=8,max=72,password"`
+}
+
+const ContentTypeMergePatchJSON = "application/merge-patch+json"
+
+// The JSON merge patch for a user, changing only the given fields.
+type PatchUserDTO struct {
+	Email    *string `json:"email,omitempty" binding:"omitnil,email,max=254"`
+	Password *string `json:"password,omitempty" binding:"omitnil,min=8,max=72,password"`
+}
+
+// The public representation of a user, never including its password.
+type UserDTO struct {
+	Id        int        `json:"id"`
+	Email     string     `json:"email"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	Version   int        `json:"version"` // Also the user's ETag, for If-Match.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func userDTO(user models.User) UserDTO {
+	return UserDTO{
+		Id:        user.Id,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		Version:   user.Version,
+		DeletedAt: user.DeletedAt,
+	}
+}
+
+var errEmailTaken = errors.New("email is already taken")
+
+// The query parameters for listing users, see db.UserListOptions.
+type ListUsersQuery struct {
+	Limit         int        `form:"limit,default=50" binding:"min=1,max=200"`
+	After         string     `form:"after"`
+	Sort          string     `form:"sort"`
+	EmailContains string     `form:"email_contains"`
+	CreatedAfter  *time.Time `form:"created_after" time_format:"2006-01-02T15:04:05Z07:00"`
+
+	IncludeDeleted bool `form:"include_deleted"`
+}
+
+// The query parameters for getting a user.
+type GetUserQuery struct {
+	IncludeDeleted bool `form:"include_deleted"`
+}
+
+// A page of users and the cursor for the "after" query parameter of the
+// next page, null on the last page.
+type UserListDTO struct {
+	Data       []UserDTO `json:"data"`
+	NextCursor *string   `json:"next_cursor"`
+}
+
+// List a page of users, with a "next" Link header unless it is the last.
 func (s *Server) ListUsers() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		users := []models.User{}
-		webMust(c, 500, s.DB.Select(&users, "SELECT * FROM users ORDER BY id"))
-		c.JSON(200, users)
+		var query ListUsersQuery
+		webMust(c, 400, c.BindQuery(&query))
+
+		page, err := s.Users.List(c.Request.Context(), db.UserListOptions{
+			Limit:         query.Limit,
+			After:         query.After,
+			Sort:          query.Sort,
+			EmailContains: query.EmailContains,
+			CreatedAfter:  query.CreatedAfter,
+
+			IncludeDeleted: query.IncludeDeleted,
+		})
+		if errors.Is(err, db.ErrInvalidListOptions) {
+			webMust(c, 400, err)
+		}
+		webMust(c, 500, err)
+
+		users := UserListDTO{Data: make([]UserDTO, len(page.Users))}
+		for i, user := range page.Users {
+			users.Data[i] = userDTO(user)
+		}
+		if page.Next != "" {
+			users.NextCursor = &page.Next
+			next := c.Request.URL.Query()
+			next.Set("after", page.Next)
+			next.Set("limit", strconv.Itoa(query.Limit))
+			c.Header("Link", fmt.Sprintf(`<%v%v?%v>; rel="next"`, s.Config.BaseURL, c.Request.URL.Path, next.Encode()))
+		}
+		renderJSON(c, 200, users)
 	}
 }
 
 func (s *Server) CreateUser() gin.HandlerFunc {
-	type NewUserDTO struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-
 	return func(c *gin.Context) {
 		var newUser NewUserDTO
-		webMust(c, 400, c.BindJSON(&newUser))
-
-		var user models.User
-		query := "INSERT INTO users (email,password) VALUES($1,$2) RETURNING *"
-		webMust(c, 500, s.DB.Get(&user, query, newUser.Email, BCryptPassword(newUser.Password)))
+		bindJSON(c, &newUser)
 
-		c.JSON(200, models.User{
-			Id:        user.Id,
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
+		user, err := s.Users.Create(c.Request.Context(), models.User{
+			Email:    newUser.Email,
+			Password: mustBCryptPassword(c, newUser.Password),
 		})
+		s.mustWriteUser(c, err)
+
+		c.Header("ETag", versionETag(user.Version))
+		renderJSON(c, 200, userDTO(user))
 	}
 }
 
@@ -45,44 +136,103 @@ func (s *Server) GetUser() gin.HandlerFunc {
 		id, err := strconv.Atoi(c.Param("id"))
 		webMust(c, 404, err)
 
-		var user models.User
-		err = s.DB.Get(&user, "SELECT * FROM users WHERE id=$1", id)
-		if err == sql.ErrNoRows {
-			s.notFound(c)
+		var query GetUserQuery
+		webMust(c, 400, c.BindQuery(&query))
+
+		user := s.mustGetUser(c, id, query.IncludeDeleted)
+		if !notModified(c, user.Version) {
+			renderJSON(c, 200, userDTO(user))
 		}
-		webMust(c, 500, err)
+	}
+}
 
-		c.JSON(200, models.User{
-			Id:        user.Id,
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
-		})
+func (s *Server) mustGetUser(c *gin.Context, id int, includeDeleted bool) models.User {
+	get := s.Users.Get
+	if includeDeleted {
+		get = s.Users.GetIncludingDeleted
+	}
+	user, err := get(c.Request.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.notFound(c)
 	}
+	webMust(c, 500, err)
+	return user
 }
 
-func (s *Server) UpdateUser() gin.HandlerFunc {
-	type UpdateUserDTO struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+// The user version required by the If-Match header, if any.
+func (s *Server) ifMatchUserVersion(c *gin.Context, id int, includeDeleted bool) int {
+	return ifMatchVersion(c, func() int { return s.mustGetUser(c, id, includeDeleted).Version })
+}
+
+// Respond 404 for missing users, 412 for other versions than required, and
+// 409 for duplicate emails.
+func (s *Server) mustWriteUser(c *gin.Context, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		s.notFound(c)
+	}
+	if errors.Is(err, db.ErrVersionMismatch) {
+		panic(WebErr{Context: c, Status: 412, Err: errPreconditionFailed})
+	}
+	if db.IsUniqueViolation(err) {
+		panic(WebErr{Context: c, Status: 409, Err: errEmailTaken, Type: ProblemTypeEmailTaken})
 	}
+	webMust(c, 500, err)
+}
+
+var errRowConflict = errors.New("conflicts with an existing row")
 
+// Respond 404 to writes of missing rows and 409 to unique violations, as the
+// generated handlers do.
+func (s *Server) mustWriteRow(c *gin.Context, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		s.notFound(c)
+	}
+	if db.IsUniqueViolation(err) {
+		panic(WebErr{Context: c, Status: 409, Err: errRowConflict})
+	}
+	webMust(c, 500, err)
+}
+
+// Replace the email and password of a user, see PatchUser to change either.
+func (s *Server) UpdateUser() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id, err := strconv.Atoi(c.Param("id"))
 		webMust(c, 404, err)
 
 		var updateUser UpdateUserDTO
-		webMust(c, 400, c.BindJSON(&updateUser))
+		bindJSON(c, &updateUser)
 
-		var user models.User
-		query := "UPDATE users SET email=$1, password=$2, updated_at=CURRENT_TIMESTAMP WHERE id=$3 RETURNING *"
-		err = s.DB.Get(&user, query, updateUser.Email, BCryptPassword(updateUser.Password), id)
-		if err == sql.ErrNoRows {
-			s.notFound(c)
+		user, err := s.Users.Update(c.Request.Context(), models.User{
+			Id:       id,
+			Email:    updateUser.Email,
+			Password: mustBCryptPassword(c, updateUser.Password),
+			Version:  s.ifMatchUserVersion(c, id, false),
+		})
+		s.mustWriteUser(c, err)
+
+		c.Header("ETag", versionETag(user.Version))
+		renderJSON(c, 200, userDTO(user))
+	}
+}
+
+func (s *Server) PatchUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		webMust(c, 404, err)
+
+		var patchUser PatchUserDTO
+		bindMergePatch(c, &patchUser)
+
+		patch := db.UserPatch{Email: patchUser.Email, Version: s.ifMatchUserVersion(c, id, false)}
+		if patchUser.Password != nil {
+			password := mustBCryptPassword(c, *patchUser.Password)
+			patch.Password = &password
 		}
-		webMust(c, 500, err)
+		user, err := s.Users.Patch(c.Request.Context(), id, patch)
+		s.mustWriteUser(c, err)
 
-		c.JSON(200, user)
+		c.Header("ETag", versionETag(user.Version))
+		renderJSON(c, 200, userDTO(user))
 	}
 }
 
@@ -91,12 +241,47 @@ func (s *Server) DeleteUser() gin.HandlerFunc {
 		id, err := strconv.Atoi(c.Param("id"))
 		webMust(c, 404, err)
 
-		_, err = s.DB.Exec("DELETE FROM users WHERE id=$1", id)
-		webMust(c, 500, err)
+		// Soft delete the user, see RestoreUser. Missing and deleted users
+		// respond 404, or 412 if they had to be at some version.
+		version := s.ifMatchUserVersion(c, id, false)
+		err = s.Users.Delete(c.Request.Context(), id, version)
+		if errors.Is(err, sql.ErrNoRows) && version != 0 {
+			err = db.ErrVersionMismatch
+		}
+		s.mustWriteUser(c, err)
 		c.Status(204)
 	}
 }
 
-func BCryptPassword(s string) string {
-	return string(must1(bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)))
+// Undo the deletion of a user, responding with it as is unless it is deleted.
+func (s *Server) RestoreUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		webMust(c, 404, err)
+
+		user, err := s.Users.Restore(c.Request.Context(), id, s.ifMatchUserVersion(c, id, true))
+		s.mustWriteUser(c, err)
+
+		c.Header("ETag", versionETag(user.Version))
+		renderJSON(c, 200, userDTO(user))
+	}
+}
+
+// The most bytes of a password bcrypt hashes.
+const maxPasswordBytes = 72
+
+func BCryptPassword(s string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Hash a password, responding 422 for one too long to hash which the
+// validation of the request should have refused already.
+func mustBCryptPassword(c *gin.Context, s string) string {
+	hash, err := BCryptPassword(s)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		mustBeValid(c, ValidationError{[]FieldError{{"password", fieldErrorCodes["password"].code, fieldErrorCodes["password"].message}}})
+	}
+	webMust(c, 500, err)
+	return hash
 }
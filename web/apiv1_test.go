@@ -1,7 +1,10 @@
 package web
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +15,7 @@ import (
 	"webapp/db"
 	"webapp/models"
 
+	"github.com/gin-gonic/gin"
 	"github.com/maerics/goutil"
 	"github.com/stretchr/testify/assert"
 )
@@ -34,6 +38,285 @@ func InitTestServer(t *testing.T) *Server {
 	return server
 }
 
+// A server without a database, storing users in memory.
+func InitMemoryTestServer(t *testing.T) *Server {
+	server, err := NewServer(Config{}, nil)
+	tmust(t, err)
+	server.Users = db.NewMemoryUserRepository()
+	server.IdempotencyKeys = db.NewMemoryIdempotencyKeyRepository()
+	return server
+}
+
+type testRequestFunc func(method, uri, body string, headers map[string]string) *httptest.ResponseRecorder
+
+// Serves requests to the server as the admin, with JSON bodies unless the
+// headers set another Content-Type.
+func testRequester(server *Server) testRequestFunc {
+	return func(method, uri, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		req.SetBasicAuth("admin", "secret")
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res
+	}
+}
+
+// Creates a user directly in the repository with the given password hash.
+func seedTestUser(t *testing.T, server *Server, email, hash string) models.User {
+	user, err := server.Users.Create(context.Background(), models.User{Email: email, Password: hash})
+	tmust(t, err)
+	return user
+}
+
+func TestUsersApiInMemory(t *testing.T) {
+	request := testRequester(InitMemoryTestServer(t))
+
+	res := request("PUT", "/api/v1/users", `{"email":"alice@example.com","password":"Secret123"}`, nil)
+	assert.Equal(t, 200, res.Code)
+	var user UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
+	assert.Equal(t, 1, user.Id)
+	assert.NotContains(t, res.Body.String(), "password")
+
+	uri := fmt.Sprintf("/api/v1/users/%v", user.Id)
+	res = request("GET", uri, "", nil)
+	assert.Equal(t, 200, res.Code)
+	var gotUser UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &gotUser))
+	assert.Equal(t, user.Email, gotUser.Email)
+
+	res = request("POST", uri, `{"email":"bob@example.com","password":"Hunter2!!"}`, nil)
+	assert.Equal(t, 200, res.Code)
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &gotUser))
+	assert.Equal(t, "bob@example.com", gotUser.Email)
+
+	assert.Equal(t, 204, request("DELETE", uri, "", nil).Code)
+	assert.Equal(t, 404, request("GET", uri, "", nil).Code)
+	res = request("GET", "/api/v1/users", "", nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, `{"data":[],"next_cursor":null}`, res.Body.String())
+}
+
+func TestListUsersPagination(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	for _, email := range []string{"carol@example.com", "alice@example.com", "bob@example.org"} {
+		seedTestUser(t, server, email, "hash")
+	}
+
+	request := testRequester(server)
+	list := func(uri string) (*httptest.ResponseRecorder, UserListDTO) {
+		res := request("GET", uri, "", nil)
+		var users UserListDTO
+		if res.Code == 200 {
+			tmust(t, json.Unmarshal(res.Body.Bytes(), &users))
+		}
+		return res, users
+	}
+
+	res, users := list("/api/v1/users?limit=2&sort=email&email_contains=EXAMPLE.COM")
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, emails(users.Data))
+	assert.Nil(t, users.NextCursor)
+	assert.Empty(t, res.Header().Get("Link"))
+
+	res, users = list("/api/v1/users?limit=2&sort=-email")
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, []string{"carol@example.com", "bob@example.org"}, emails(users.Data))
+	assert.NotNil(t, users.NextCursor)
+	link := res.Header().Get("Link")
+	assert.Regexp(t, `^</api/v1/users\?[^>]*after=[^>]*>; rel="next"$`, link)
+
+	res, users = list(strings.TrimPrefix(strings.Split(link, ">")[0], "<"))
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, []string{"alice@example.com"}, emails(users.Data))
+	assert.Nil(t, users.NextCursor)
+
+	res, users = list("/api/v1/users?created_after=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	assert.Equal(t, 200, res.Code)
+	assert.Empty(t, users.Data)
+
+	for _, query := range []string{"limit=0", "limit=201", "sort=password", "after=bogus", "created_after=yesterday"} {
+		res, _ = list("/api/v1/users?" + query)
+		assert.Equal(t, 400, res.Code, query)
+	}
+}
+
+func emails(users []UserDTO) []string {
+	var emails []string
+	for _, user := range users {
+		emails = append(emails, user.Email)
+	}
+	return emails
+}
+
+func TestUsersApiValidation(t *testing.T) {
+	request := testRequester(InitMemoryTestServer(t))
+
+	res := request("PUT", "/api/v1/users", `{}`, nil)
+	assert.Equal(t, 422, res.Code)
+	assert.Equal(t, map[string]string{"email": "required", "password": "required"}, fieldErrors(t, res))
+
+	for body, codes := range map[string]map[string]string{
+		`{"email":"alice","password":"Secret123"}`:             {"email": "invalid_email"},
+		`{"email":"alice@example.com","password":"Sec1"}`:      {"password": "too_short"},
+		`{"email":"alice@example.com","password":"secretpwd"}`: {"password": "weak_password"},
+		`{"email":"alice","password":"secret"}`:                {"email": "invalid_email", "password": "too_short"},
+
+		// 72 characters but 141 bytes, too long for bcrypt.
+		`{"email":"alice@example.com","password":"Aa1` + strings.Repeat("é", 69) + `"}`: {"password": "weak_password"},
+	} {
+		res = request("PUT", "/api/v1/users", body, nil)
+		assert.Equal(t, 422, res.Code, body)
+		assert.Equal(t, codes, fieldErrors(t, res), body)
+	}
+	assert.Equal(t, 400, request("PUT", "/api/v1/users", `{"email":`, nil).Code)
+
+	res = request("PUT", "/api/v1/users", `{"email":"alice@example.com","password":"Secret123"}`, nil)
+	assert.Equal(t, 200, res.Code)
+	res = request("PUT", "/api/v1/users", `{"email":"bob@example.com","password":"Secret123"}`, nil)
+	assert.Equal(t, 200, res.Code)
+	var bob UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &bob))
+
+	res = request("PUT", "/api/v1/users", `{"email":"alice@example.com","password":"Secret123"}`, nil)
+	assert.Equal(t, 409, res.Code)
+	var problem Problem
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &problem))
+	assert.Equal(t, ProblemTypeEmailTaken, problem.Type)
+	assert.Equal(t, "email is already taken", problem.Detail)
+	res = request("POST", fmt.Sprintf("/api/v1/users/%v", bob.Id), `{"email":"alice@example.com","password":"Secret123"}`, nil)
+	assert.Equal(t, 409, res.Code)
+	res = request("POST", fmt.Sprintf("/api/v1/users/%v", bob.Id), `{"email":"bob@example.com","password":"weak"}`, nil)
+	assert.Equal(t, 422, res.Code)
+}
+
+// The codes of a validation problem by field.
+func fieldErrors(t *testing.T, res *httptest.ResponseRecorder) map[string]string {
+	var problem Problem
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &problem))
+	assert.Equal(t, ProblemTypeValidation, problem.Type)
+	codes := map[string]string{}
+	for _, field := range problem.Errors {
+		codes[field.Field] = field.Code
+	}
+	return codes
+}
+
+func TestPatchUser(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	request := testRequester(server)
+	patch := func(uri, contentType, body string) *httptest.ResponseRecorder {
+		return request("PATCH", uri, body, map[string]string{"Content-Type": contentType})
+	}
+	created := seedTestUser(t, server, "alice@example.com", "hash")
+	seedTestUser(t, server, "bob@example.com", "hash")
+	uri := fmt.Sprintf("/api/v1/users/%v", created.Id)
+
+	res := patch(uri, ContentTypeMergePatchJSON, `{"email":"carol@example.com"}`)
+	assert.Equal(t, 200, res.Code)
+	var user UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
+	assert.Equal(t, "carol@example.com", user.Email)
+	assert.True(t, user.UpdatedAt.After(*created.UpdatedAt))
+	stored, err := server.Users.Get(context.Background(), created.Id)
+	tmust(t, err)
+	assert.Equal(t, "hash", stored.Password)
+
+	res = patch(uri, ContentTypeMergePatchJSON, `{"password":"Hunter2!!"}`)
+	assert.Equal(t, 200, res.Code)
+	stored, err = server.Users.Get(context.Background(), created.Id)
+	tmust(t, err)
+	assert.Equal(t, "carol@example.com", stored.Email)
+	assert.True(t, strings.HasPrefix(stored.Password, "$2a$"))
+
+	res = patch(uri, ContentTypeMergePatchJSON, `{}`)
+	assert.Equal(t, 200, res.Code)
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
+	assert.Equal(t, stored.UpdatedAt, user.UpdatedAt)
+
+	res = patch(uri, "application/json", `{"email":"dave@example.com"}`)
+	assert.Equal(t, 415, res.Code)
+	assert.Equal(t, ContentTypeMergePatchJSON, res.Header().Get("Accept-Patch"))
+	for body, status := range map[string]int{
+		`["email"]`:                   400,
+		`{"email":"bob@example.com"}`: 409,
+		`{"email":null}`:              422,
+		`{"password":""}`:             422,
+	} {
+		assert.Equal(t, status, patch(uri, ContentTypeMergePatchJSON, body).Code, body)
+	}
+	res = patch(uri, ContentTypeMergePatchJSON, `{"email":null,"password":"weak"}`)
+	assert.Equal(t, map[string]string{"email": "required"}, fieldErrors(t, res))
+	res = patch(uri, ContentTypeMergePatchJSON, `{"email":"dave","password":"weak"}`)
+	assert.Equal(t, map[string]string{"email": "invalid_email", "password": "too_short"}, fieldErrors(t, res))
+	res = patch("/api/v1/users/1000", ContentTypeMergePatchJSON, `{"email":"dave@example.com"}`)
+	assert.Equal(t, 404, res.Code)
+}
+
+func TestUserConditionalRequests(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	request := testRequester(server)
+	user := seedTestUser(t, server, "alice@example.com", "hash")
+	uri := fmt.Sprintf("/api/v1/users/%v", user.Id)
+
+	res := request("GET", uri, "", nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, `"1"`, res.Header().Get("ETag"))
+	for _, tag := range []string{`"1"`, `W/"1"`, `"0", "1"`, "*"} {
+		res = request("GET", uri, "", map[string]string{"If-None-Match": tag})
+		assert.Equal(t, 304, res.Code, tag)
+		assert.Empty(t, res.Body.String(), tag)
+	}
+	assert.Equal(t, 200, request("GET", uri, "", map[string]string{"If-None-Match": `"2"`}).Code)
+
+	body := `{"email":"bob@example.com","password":"Hunter2!!"}`
+	res = request("PUT", uri, body, map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, `"2"`, res.Header().Get("ETag"))
+
+	// A second client still holding the first version.
+	for _, tag := range []string{`"1"`, `W/"2"`, `"0"`, `"1", "3"`, "bogus"} {
+		res = request("PUT", uri, body, map[string]string{"If-Match": tag})
+		assert.Equal(t, 412, res.Code, tag)
+		res = request("DELETE", uri, "", map[string]string{"If-Match": tag})
+		assert.Equal(t, 412, res.Code, tag)
+	}
+	res = request("PATCH", uri, `{}`, map[string]string{"If-Match": `"1"`, "Content-Type": ContentTypeMergePatchJSON})
+	assert.Equal(t, 412, res.Code)
+	res = request("PATCH", uri, `{"email":"carol@example.com"}`, map[string]string{"If-Match": `"1", "2"`, "Content-Type": ContentTypeMergePatchJSON})
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, `"3"`, res.Header().Get("ETag"))
+
+	assert.Equal(t, 204, request("DELETE", uri, "", map[string]string{"If-Match": `"3"`}).Code)
+	assert.Equal(t, 412, request("DELETE", uri, "", map[string]string{"If-Match": `"3"`}).Code)
+	assert.Equal(t, 404, request("DELETE", uri, "", nil).Code)
+}
+
+// The errors of the generated handlers' writes.
+func TestMustWriteRow(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	for err, status := range map[error]int{
+		nil:                   204,
+		sql.ErrNoRows:         404,
+		db.ErrUniqueViolation: 409,
+		errors.New("boom"):    500,
+	} {
+		server.GET(fmt.Sprintf("/write/%v", status), func(c *gin.Context) {
+			server.mustWriteRow(c, err)
+			c.Status(204)
+		})
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", fmt.Sprintf("/write/%v", status), nil)
+		req.Header.Set("Accept", ContentTypeProblemJSON)
+		server.ServeHTTP(res, req)
+		assert.Equal(t, status, res.Code, err)
+	}
+}
+
 func TestUsersApiNoAuth(t *testing.T) {
 	server := InitTestServer(t)
 
@@ -45,6 +328,8 @@ func TestUsersApiNoAuth(t *testing.T) {
 		newReq("GET", "/api/v1/users", nil),
 		newReq("PUT", "/api/v1/users", strings.NewReader(`{"name":"Alice"}`)),
 		newReq("POST", "/api/v1/users/1", strings.NewReader(`{"name":"Bob"}`)),
+		newReq("PUT", "/api/v1/users/1", strings.NewReader(`{"name":"Bob"}`)),
+		newReq("PATCH", "/api/v1/users/1", strings.NewReader(`{"name":"Bob"}`)),
 		newReq("DELETE", "/api/v1/users/1", nil),
 	} {
 		req, err := requestFunc()
@@ -55,6 +340,60 @@ func TestUsersApiNoAuth(t *testing.T) {
 	}
 }
 
+func TestOpenAPI(t *testing.T) {
+	server := InitMemoryTestServer(t)
+
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	assert.Equal(t, 200, res.Code)
+
+	var doc struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &doc))
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+	assert.NotContains(t, doc.Paths, "/openapi.json")
+	assert.Contains(t, doc.Paths["/users"], "get")
+	assert.Contains(t, doc.Paths["/users"], "put")
+	for _, method := range []string{"get", "post", "delete"} {
+		assert.Contains(t, doc.Paths["/users/{id}"], method)
+	}
+	assert.Equal(t, "getUser", doc.Paths["/users/{id}"]["get"]["operationId"])
+	for _, schema := range []string{"NewUserDTO", "UpdateUserDTO", "UserDTO", "Problem", "FieldError"} {
+		assert.Contains(t, doc.Components.Schemas, schema)
+	}
+	assert.NotContains(t, doc.Components.Schemas["UserDTO"].(map[string]any)["properties"], "password")
+
+	// Parameters by location and name.
+	params := func(method, path string) map[string]map[string]any {
+		params := map[string]map[string]any{}
+		list, _ := doc.Paths[path][method]["parameters"].([]any)
+		for _, p := range list {
+			param := p.(map[string]any)
+			params[param["in"].(string)+" "+param["name"].(string)] = param
+		}
+		return params
+	}
+	limit := params("get", "/users")["query limit"]["schema"]
+	assert.Equal(t, map[string]any{"type": "integer", "minimum": 1.0, "maximum": 200.0, "default": 50.0}, limit)
+
+	get := doc.Paths["/users/{id}"]["get"]
+	assert.Contains(t, params("get", "/users/{id}"), "header If-None-Match")
+	assert.Contains(t, get["responses"], "304")
+	assert.Contains(t, get["responses"].(map[string]any)["200"].(map[string]any)["headers"], "ETag")
+	for _, method := range []string{"put", "patch", "post", "delete"} {
+		assert.Contains(t, params(method, "/users/{id}"), "header If-Match", method)
+		assert.Contains(t, params(method, "/users/{id}"), "header "+HeaderIdempotencyKey, method)
+		assert.Contains(t, doc.Paths["/users/{id}"][method]["responses"], "412", method)
+	}
+	assert.Contains(t, params("put", "/users"), "header "+HeaderIdempotencyKey)
+	assert.NotContains(t, params("get", "/users/{id}"), "header "+HeaderIdempotencyKey)
+}
+
 func TestListUsersEmptyDB(t *testing.T) {
 	server := InitTestServer(t)
 
@@ -66,7 +405,7 @@ func TestListUsersEmptyDB(t *testing.T) {
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 200, res.Code)
-	assert.Equal(t, "[]", res.Body.String())
+	assert.Equal(t, `{"data":[],"next_cursor":null}`, res.Body.String())
 }
 
 func TestListUsersWithOneUser(t *testing.T) {
@@ -83,13 +422,15 @@ func TestListUsersWithOneUser(t *testing.T) {
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 200, res.Code)
-	var users []models.User
+	var users UserListDTO
 	tmust(t, json.Unmarshal(res.Body.Bytes(), &users))
-	assert.Equal(t, 1, len(users))
-	user := users[0]
+	assert.Equal(t, 1, len(users.Data))
+	assert.Nil(t, users.NextCursor)
+	user := users.Data[0]
 	assert.LessOrEqual(t, 1, user.Id)
 	assert.Equal(t, "foo", user.Email)
-	assert.Equal(t, "bar", user.Password)
+	assert.NotContains(t, res.Body.String(), "password")
+	assert.NotContains(t, res.Body.String(), "bar")
 
 	epsilon, err := time.ParseDuration("5s")
 	tmust(t, err)
@@ -101,7 +442,7 @@ func TestListUsersWithOneUser(t *testing.T) {
 func TestCreateUser(t *testing.T) {
 	server := InitTestServer(t)
 
-	reqBody := `{"email":"alice","password":"secret"}`
+	reqBody := `{"email":"alice@example.com","password":"Secret123"}`
 	req, err := http.NewRequest("PUT", "/api/v1/users", strings.NewReader(reqBody))
 	req.SetBasicAuth("admin", "secret")
 	req.Header.Add(ContentTypeHeaderValue, ContentTypeTextJSON)
@@ -110,11 +451,11 @@ func TestCreateUser(t *testing.T) {
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 200, res.Code)
-	var user models.User
+	var user UserDTO
 	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
 	assert.LessOrEqual(t, 1, user.Id)
-	assert.Equal(t, "alice", user.Email)
-	assert.Equal(t, "", user.Password)
+	assert.Equal(t, "alice@example.com", user.Email)
+	assert.NotContains(t, res.Body.String(), "password")
 
 	epsilon, err := time.ParseDuration("5s")
 	tmust(t, err)
@@ -127,7 +468,7 @@ func TestGetUser(t *testing.T) {
 	server := InitTestServer(t)
 
 	// Create the new user
-	reqBody := `{"email":"alice","password":"password"}`
+	reqBody := `{"email":"alice@example.com","password":"Passw0rd"}`
 	req, err := http.NewRequest("PUT", "/api/v1/users", strings.NewReader(reqBody))
 	req.SetBasicAuth("admin", "secret")
 	req.Header.Add(ContentTypeHeaderValue, ContentTypeTextJSON)
@@ -136,7 +477,7 @@ func TestGetUser(t *testing.T) {
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 200, res.Code)
-	var user models.User
+	var user UserDTO
 	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
 
 	// Fetch the new user by id
@@ -146,7 +487,7 @@ func TestGetUser(t *testing.T) {
 	tmust(t, err)
 	res2 := httptest.NewRecorder()
 	server.ServeHTTP(res2, req2)
-	var gotUser models.User
+	var gotUser UserDTO
 	tmust(t, json.Unmarshal(res2.Body.Bytes(), &gotUser))
 	assert.Equal(t, user, gotUser)
 }
@@ -155,7 +496,7 @@ func TestUpdateUser(t *testing.T) {
 	server := InitTestServer(t)
 
 	// Create the new user
-	reqBody := `{"email":"alice","password":"password"}`
+	reqBody := `{"email":"alice@example.com","password":"Passw0rd"}`
 	req, err := http.NewRequest("PUT", "/api/v1/users", strings.NewReader(reqBody))
 	req.SetBasicAuth("admin", "secret")
 	req.Header.Add(ContentTypeHeaderValue, ContentTypeTextJSON)
@@ -164,23 +505,24 @@ func TestUpdateUser(t *testing.T) {
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 200, res.Code)
-	var user models.User
+	var user UserDTO
 	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
 
 	// Update the user
-	reqBody = `{"email":"bob","password":"123456"}`
+	reqBody = `{"email":"bob@example.com","password":"Hunter2!!"}`
 	uri := fmt.Sprintf("/api/v1/users/%v", user.Id)
-	req2, err := http.NewRequest("POST", uri, strings.NewReader(reqBody))
+	req2, err := http.NewRequest("PUT", uri, strings.NewReader(reqBody))
 	req2.SetBasicAuth("admin", "secret")
 	req2.Header.Add(ContentTypeHeaderValue, ContentTypeTextJSON)
 	tmust(t, err)
 	res2 := httptest.NewRecorder()
 	server.ServeHTTP(res2, req2)
 	assert.Equal(t, 200, res2.Code)
-	var updatedUser models.User
+	var updatedUser UserDTO
 	tmust(t, json.Unmarshal(res2.Body.Bytes(), &updatedUser))
-	assert.Equal(t, "bob", updatedUser.Email)
-	assert.True(t, strings.HasPrefix(updatedUser.Password, "$2a$10"))
+	assert.Equal(t, "bob@example.com", updatedUser.Email)
+	assert.NotContains(t, res2.Body.String(), "password")
+	assert.NotContains(t, res2.Body.String(), "$2a$")
 
 	// TODO: Fetch the user
 }
@@ -202,6 +544,63 @@ func TestDeleteUser(t *testing.T) {
 	assert.Equal(t, 204, res.Code)
 
 	var userCount int
-	tmust(t, server.DB.Get(&userCount, "SELECT COUNT(id) FROM users"))
+	tmust(t, server.DB.Get(&userCount, "SELECT COUNT(id) FROM users WHERE deleted_at IS NULL"))
 	assert.Equal(t, 0, userCount)
+	tmust(t, server.DB.Get(&userCount, "SELECT COUNT(id) FROM users"))
+	assert.Equal(t, 1, userCount, "soft deleted")
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	request := testRequester(server)
+	users := func(query string) []string {
+		res := request("GET", "/api/v1/users"+query, "", nil)
+		assert.Equal(t, 200, res.Code)
+		var users UserListDTO
+		tmust(t, json.Unmarshal(res.Body.Bytes(), &users))
+		return emails(users.Data)
+	}
+	hash, err := BCryptPassword("Secret123")
+	tmust(t, err)
+	seedTestUser(t, server, "alice@example.com", hash)
+	seedTestUser(t, server, "bob@example.com", hash)
+
+	assert.Equal(t, 204, request("DELETE", "/api/v1/users/1", "", nil).Code)
+	assert.Equal(t, 404, request("DELETE", "/api/v1/users/1", "", nil).Code)
+	assert.Equal(t, 404, request("DELETE", "/api/v1/users/1000", "", nil).Code)
+	assert.Equal(t, 404, request("GET", "/api/v1/users/1", "", nil).Code)
+	assert.Equal(t, []string{"bob@example.com"}, users(""))
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, users("?include_deleted=true"))
+
+	res := request("GET", "/api/v1/users/1?include_deleted=true", "", nil)
+	assert.Equal(t, 200, res.Code)
+	var user UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
+	assert.NotNil(t, user.DeletedAt)
+
+	// Deleted users can't log in.
+	login := httptest.NewRequest("POST", "/login", strings.NewReader("email=alice@example.com&password=Secret123"))
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, login)
+	assert.Equal(t, 401, res.Code)
+
+	res = request("POST", "/api/v1/users/1/restore", "", nil)
+	assert.Equal(t, 200, res.Code)
+	user = UserDTO{}
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &user))
+	assert.Nil(t, user.DeletedAt)
+	assert.Equal(t, versionETag(user.Version), res.Header().Get("ETag"))
+	assert.Equal(t, 200, request("POST", "/api/v1/users/1/restore", "", nil).Code)
+	assert.Equal(t, 404, request("POST", "/api/v1/users/1000/restore", "", nil).Code)
+	assert.Equal(t, 200, request("GET", "/api/v1/users/1", "", nil).Code)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, users(""))
+
+	// The email of a deleted user can be taken again, and then it can't be
+	// restored until the email is free.
+	assert.Equal(t, 204, request("DELETE", "/api/v1/users/2", "", nil).Code)
+	res = request("PUT", "/api/v1/users", `{"email":"bob@example.com","password":"Hunter2!!"}`, nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, 409, request("POST", "/api/v1/users/2/restore", "", nil).Code)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com", "bob@example.com"}, users("?include_deleted=true"))
 }
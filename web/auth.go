@@ -23,11 +23,14 @@ func unauthorized(ctx *gin.Context) {
 }
 
 func (s *Server) loggedInUser(ctx *gin.Context) *models.User {
-	var user models.User
 	session := sessions.Default(ctx)
 	switch id := session.Get(SessionUserId).(type) {
 	case int:
-		webMust(ctx, 500, s.DB.Get(&user, "SELECT * FROM users WHERE id=$1", id))
+		user, err := s.Users.Get(ctx.Request.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			unauthorized(ctx) // Deleted since logging in.
+		}
+		webMust(ctx, 500, err)
 		user.Password = ""
 		return &user
 	}
@@ -73,12 +76,11 @@ func (s *Server) Login() gin.HandlerFunc {
 		}
 
 		// Find the identified user.
-		var user models.User
-		query := "SELECT * FROM users WHERE email=$1"
-		err := s.DB.Get(&user, query, creds.Email)
+		user, err := s.Users.GetByEmail(ctx.Request.Context(), creds.Email)
 		if errors.Is(err, sql.ErrNoRows) || isEmpty(user.Password) {
 			unauthorized(ctx)
 		}
+		webMust(ctx, 500, err)
 
 		// See if the login is correct.
 		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
@@ -92,6 +94,13 @@ func (s *Server) Login() gin.HandlerFunc {
 	}
 }
 
+// Respond with the logged in user, see LoginAuth.
+func (s *Server) LoginUser() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		renderJSON(ctx, 200, userDTO(*s.loggedInUser(ctx)))
+	}
+}
+
 func (s *Server) Logout() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		ctx.SetCookie(SessionCookieName, "", -1, "/", "", true, true)
@@ -3,6 +3,7 @@ package web
 import (
 	"io/fs"
 	"runtime/debug"
+	"time"
 )
 
 type Config struct {
@@ -15,6 +16,9 @@ type Config struct {
 	Filename404  string `json:"-"`
 
 	CookieEncryptionKeys [][]byte
+
+	// How long to replay responses by idempotency key, see Idempotency.
+	IdempotencyKeysTTL time.Duration `json:"idempotency_keys_ttl"`
 }
 
 type BuildInfo struct {
@@ -0,0 +1,78 @@
+package web
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errPreconditionFailed = errors.New("the resource has changed, get it again for its current ETag")
+
+// The strong entity tag of a version of a resource, like "3".
+func versionETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// The versions of the entity tags in an If-Match or If-None-Match header,
+// and whether it is "*". Weak tags only match for If-None-Match.
+func etagVersions(header string, weak bool) (versions []int, wildcard bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if s, err := strconv.Unquote(tag); err == nil && strings.HasPrefix(tag, `"`) {
+			if version, err := strconv.Atoi(s); err == nil {
+				versions = append(versions, version)
+			}
+		}
+	}
+	return versions, false
+}
+
+// The version an If-Match header requires a write to apply to, zero if any.
+// Headers listing several tags are checked against the current version,
+// which the write checks again, and with none that could match respond 412.
+func ifMatchVersion(c *gin.Context, current func() int) int {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return 0
+	}
+	versions, wildcard := etagVersions(header, false)
+	switch {
+	case wildcard:
+		return 0
+	case len(versions) == 1 && versions[0] > 0:
+		return versions[0]
+	}
+	version := 0
+	if len(versions) > 1 {
+		version = current()
+	}
+	for _, v := range versions {
+		if v == version && version > 0 {
+			return version
+		}
+	}
+	panic(WebErr{Context: c, Status: 412, Err: errPreconditionFailed})
+}
+
+// Set the ETag of a version, and respond 304 Not Modified if it matches the
+// If-None-Match header of a read.
+func notModified(c *gin.Context, version int) bool {
+	c.Header("ETag", versionETag(version))
+	versions, match := etagVersions(c.GetHeader("If-None-Match"), true)
+	for _, v := range versions {
+		match = match || v == version
+	}
+	if match && (c.Request.Method == "GET" || c.Request.Method == "HEAD") {
+		c.Status(304)
+		return true
+	}
+	return false
+}
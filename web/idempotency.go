@@ -0,0 +1,194 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+	"webapp/db"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/maerics/golog"
+)
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	HeaderIdempotentReplayed  = "Idempotent-Replayed"
+	DefaultIdempotencyKeysTTL = 24 * time.Hour
+
+	// How often ExpireIdempotencyKeys deletes the keys older than the TTL.
+	IdempotencyKeysExpireInterval = time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	errIdempotencyKeyTooLong = errors.New("idempotency key must be at most 255 characters")
+	errIdempotencyKeyReused  = errors.New("idempotency key was already used for a different request")
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is in progress, retry later")
+)
+
+// Replay the stored response of an earlier request with the same
+// Idempotency-Key header, made by the same user within the TTL, instead of
+// handling it again. Reusing a key for another request responds 422, and
+// while the first request is in progress 409. Every response but server
+// errors is stored, including the problems of webMust, so only requests
+// which failed with 5xx can be retried.
+func (s *Server) Idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(HeaderIdempotencyKey)
+		if key == "" || s.IdempotencyKeys == nil || c.Request.Method == "GET" || c.Request.Method == "HEAD" {
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			webMust(c, 400, errIdempotencyKeyTooLong)
+		}
+		key = c.GetString(gin.AuthUserKey) + ":" + key
+
+		body, err := io.ReadAll(c.Request.Body)
+		webMust(c, 400, err)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(c.Request, body)
+
+		record, claimed, err := s.IdempotencyKeys.Claim(c.Request.Context(), key, fingerprint, s.idempotencyKeysExpiry())
+		webMust(c, 500, err)
+		switch {
+		case !claimed && record.Fingerprint != fingerprint:
+			webMust(c, 422, errIdempotencyKeyReused)
+		case !claimed && record.Status == 0:
+			webMust(c, 409, errIdempotencyInProgress)
+		case !claimed:
+			replayResponse(c, record)
+			return
+		}
+
+		// Release the key unless the response is stored, e.g. on panics, even
+		// if the client has gone away so its retries aren't refused.
+		ctx := context.Background()
+		completed := false
+		defer func() {
+			if !completed {
+				if err := s.IdempotencyKeys.Release(ctx, key); err != nil {
+					log.Errorf("failed to release idempotency key: %v", err)
+				}
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		s.nextRespondingWebErrs(c)
+		if status := c.Writer.Status(); status < 500 {
+			record.Status, record.Body = status, recorder.body.Bytes()
+			record.Headers = string(log.Must1(json.Marshal(storedHeaders(c.Writer.Header()))))
+			err := s.IdempotencyKeys.Complete(ctx, record)
+			completed = err == nil
+			if err != nil {
+				log.Errorf("failed to store idempotent response: %v", err)
+			}
+		}
+	}
+}
+
+// Run the next handlers, responding to their WebErr panics here rather than
+// in MustMiddleware so that the response can be stored.
+func (s *Server) nextRespondingWebErrs(c *gin.Context) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			webErr, ok := recovered.(WebErr)
+			if !ok {
+				panic(recovered)
+			}
+			s.respondWebErr(c, webErr)
+		}
+	}()
+	c.Next()
+}
+
+// Delete the idempotency keys older than the TTL every interval, until the
+// context is done, since Claim only replaces expired keys when reused.
+func (s *Server) ExpireIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.deleteExpiredIdempotencyKeys(ctx)
+		}
+	}
+}
+
+func (s *Server) deleteExpiredIdempotencyKeys(ctx context.Context) {
+	n, err := s.IdempotencyKeys.DeleteExpired(ctx, s.idempotencyKeysExpiry())
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("failed to delete expired idempotency keys: %v", err)
+	} else if n > 0 {
+		log.Debugf("deleted %v expired idempotency key(s)", n)
+	}
+}
+
+// The time before which idempotency keys are expired.
+func (s *Server) idempotencyKeysExpiry() time.Time {
+	ttl := s.Config.IdempotencyKeysTTL
+	if ttl == 0 {
+		ttl = DefaultIdempotencyKeysTTL
+	}
+	return time.Now().Add(-ttl)
+}
+
+// A hash of the parts of a request which must match to replay its response.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, part := range []string{r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// The response headers worth replaying, not ones specific to the first
+// request like its ID or cookies.
+func storedHeaders(header http.Header) http.Header {
+	stored := http.Header{}
+	for _, name := range []string{"Content-Type", "ETag", "Link", "Location"} {
+		if values := header.Values(name); len(values) > 0 {
+			stored[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return stored
+}
+
+func replayResponse(c *gin.Context, record db.IdempotencyRecord) {
+	var header http.Header
+	webMust(c, 500, json.Unmarshal([]byte(record.Headers), &header))
+	for name, values := range header {
+		c.Writer.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	c.Header(HeaderIdempotentReplayed, "true")
+	c.Writer.WriteHeader(record.Status)
+	c.Writer.Write(record.Body)
+	c.Abort()
+}
+
+// A response writer which keeps a copy of the body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(bs []byte) (int, error) {
+	w.body.Write(bs)
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"webapp/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	do := testRequester(server)
+	request := func(method, uri, key, body string) *httptest.ResponseRecorder {
+		if key == "" {
+			return do(method, uri, body, nil)
+		}
+		return do(method, uri, body, map[string]string{HeaderIdempotencyKey: key})
+	}
+
+	body := `{"email":"alice@example.com","password":"Secret123"}`
+	first := request("PUT", "/api/v1/users", "key1", body)
+	assert.Equal(t, 200, first.Code)
+	assert.Empty(t, first.Header().Get(HeaderIdempotentReplayed))
+
+	// Retries replay the response rather than responding 409 for the email.
+	retry := request("PUT", "/api/v1/users", "key1", body)
+	assert.Equal(t, 200, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"))
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.NotEqual(t, first.Header().Get(HeaderRequestID), retry.Header().Get(HeaderRequestID))
+	page, err := server.Users.List(context.Background(), db.UserListOptions{})
+	tmust(t, err)
+	assert.Len(t, page.Users, 1)
+
+	res := request("PUT", "/api/v1/users", "key1", `{"email":"bob@example.com","password":"Secret123"}`)
+	assert.Equal(t, 422, res.Code)
+	assert.Equal(t, 409, request("PUT", "/api/v1/users", "", body).Code)
+	assert.Equal(t, 409, request("PUT", "/api/v1/users", "key2", body).Code)
+	assert.Equal(t, 400, request("PUT", "/api/v1/users", strings.Repeat("k", 256), body).Code)
+
+	// Client errors are replayed too, so the key can't be used again.
+	body = `{"email":"bob@example.com","password":"weak"}`
+	first = request("PUT", "/api/v1/users", "key3", body)
+	assert.Equal(t, 422, first.Code)
+	retry = request("PUT", "/api/v1/users", "key3", body)
+	assert.Equal(t, 422, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, ContentTypeProblemJSON, retry.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, map[string]string{"password": "too_short"}, fieldErrors(t, retry))
+	body = `{"email":"bob@example.com","password":"Hunter2!!"}`
+	assert.Equal(t, 422, request("PUT", "/api/v1/users", "key3", body).Code)
+	res = request("PUT", "/api/v1/users", "key5", body)
+	assert.Equal(t, 200, res.Code)
+	var bob UserDTO
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &bob))
+	assert.Equal(t, "bob@example.com", bob.Email)
+
+	// A key in progress can't be used by another request.
+	req := httptest.NewRequest("DELETE", "/api/v1/users/1", nil)
+	req.Header.Set("Content-Type", "application/json")
+	fingerprint := requestFingerprint(req, nil)
+	_, claimed, err := server.IdempotencyKeys.Claim(context.Background(), "admin:key4", fingerprint, time.Now().Add(-time.Hour))
+	tmust(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, 409, request("DELETE", "/api/v1/users/1", "key4", "").Code)
+}
+
+func TestExpireIdempotencyKeys(t *testing.T) {
+	server := InitMemoryTestServer(t)
+	server.Config.IdempotencyKeysTTL = time.Millisecond
+	ctx := context.Background()
+	_, claimed, err := server.IdempotencyKeys.Claim(ctx, "admin:key1", "fingerprint", time.Time{})
+	tmust(t, err)
+	assert.True(t, claimed)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		server.ExpireIdempotencyKeys(ctx, time.Millisecond)
+		close(done)
+	}()
+	// Claim only succeeds once the key was deleted, since it's never too old.
+	assert.Eventually(t, func() bool {
+		_, claimed, err := server.IdempotencyKeys.Claim(ctx, "admin:key1", "fingerprint", time.Time{})
+		tmust(t, err)
+		return claimed
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
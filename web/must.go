@@ -2,6 +2,8 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,9 +11,11 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"webapp/db"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/maerics/golog"
+	util "github.com/maerics/goutil"
 )
 
 const (
@@ -25,59 +29,33 @@ type WebErr struct {
 	Context *gin.Context
 	Status  int
 	Err     error
+
+	// Optional problem details for the response, see Problem.
+	Type       string
+	Title      string
+	Detail     string
+	Extensions map[string]any
 }
 
 func webMust(c *gin.Context, status int, err error) {
 	if err != nil {
-		panic(WebErr{c, status, err})
+		panic(WebErr{Context: c, Status: status, Err: err})
 	}
 }
 
 // Recovery middleware which enables using the "webMust(...)" function
 // which abuses panics to avoid repetitive boilerplate error handling.
 func (s *Server) MustMiddleware() gin.HandlerFunc {
-	const jsonContentType = "text/json; charset=utf-8"
-
 	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
 		// Handle WebErr types specially.
 		if webErr, ok := recovered.(WebErr); ok {
-			log.Debugf("recovered WebErr -> (%v,%q,%v)",
-				webErr.Status, statusMessage(webErr.Status), webErr.Err)
-
-			// Always print the stack trace for 5xx class errors.
-			if webErr.Status/100 == 5 {
-				log.Errorf("%v\n%v", webErr.Err, string(stack(5)))
-			}
-
-			filename404 := firstNonEmpty(s.Config.Filename404, DefaultFilename404)
-			filename500 := firstNonEmpty(s.Config.Filename500, DefaultFilename500)
-			respond404 := func() { s.mustServeHTML(c, 404, filename404) }
-			respond500 := func() { s.mustServeHTML(c, webErr.Status, filename500) }
-			if preferJson(c.Request.Header) {
-				respond404 = func() { c.Data(404, jsonContentType, []byte(`{"error":"not found"}`)) }
-				respond500 = func() { c.Data(500, jsonContentType, []byte(`{"error":"internal server error"}`)) }
-			}
-
-			// Respond with common 404, 500, or JSON responses.
-			switch true {
-			case webErr.Status == 404:
-				respond404()
-			case webErr.Status/100 == 4:
-				c.JSON(webErr.Status, gin.H{"error": webErr.Err.Error()})
-			case webErr.Status/100 == 5:
-				c.Error(webErr.Err)
-				respond500()
-			default:
-				c.Error(webErr.Err)
-				c.JSON(webErr.Status, gin.H{"error": statusMessage(webErr.Status)})
-			}
-			c.Abort()
+			s.respondWebErr(c, webErr)
 			return
 		}
 
 		// Fallback with 500 internal server error.
 		if preferJson(c.Request.Header) {
-			c.Data(500, jsonContentType, []byte(`{"error":"internal server error"}`))
+			respondProblem(c, newProblem(c, WebErr{Status: 500}))
 		} else {
 			s.mustServeHTML(c, 500, firstNonEmpty(s.Config.Filename500, DefaultFilename500))
 		}
@@ -86,11 +64,56 @@ func (s *Server) MustMiddleware() gin.HandlerFunc {
 	})
 }
 
+// Respond with the status and problem details of a WebErr, or the HTML
+// 404 and 5xx pages unless JSON is preferred.
+func (s *Server) respondWebErr(c *gin.Context, webErr WebErr) {
+	webErr.Status = timeoutStatus(webErr)
+	log.Debugf("recovered WebErr -> (%v,%q,%v)",
+		webErr.Status, statusMessage(webErr.Status), webErr.Err)
+
+	// Always print the stack trace for 5xx class errors.
+	if webErr.Status/100 == 5 {
+		log.Errorf("%v\n%v", webErr.Err, string(stack(5)))
+	}
+	if webErr.Err != nil && webErr.Status != 404 {
+		c.Error(webErr.Err)
+	}
+
+	// Respond with HTML 404 and 5xx pages unless JSON is preferred,
+	// otherwise with problem details.
+	switch {
+	case webErr.Status == 404 && !preferJson(c.Request.Header):
+		s.mustServeHTML(c, 404, firstNonEmpty(s.Config.Filename404, DefaultFilename404))
+	case webErr.Status/100 == 5 && !preferJson(c.Request.Header):
+		s.mustServeHTML(c, webErr.Status, firstNonEmpty(s.Config.Filename500, DefaultFilename500))
+	default:
+		respondProblem(c, newProblem(c, webErr))
+	}
+	c.Abort()
+}
+
+func respondProblem(c *gin.Context, problem Problem) {
+	c.Data(problem.Status, ContentTypeProblemJSON, []byte(util.MustJson(problem)))
+}
+
+// Queries which ran out of time are reported as 504 gateway timeout and
+// those canceled, usually by the client going away, as 503 service
+// unavailable, whatever status the handler passed to webMust.
+func timeoutStatus(webErr WebErr) int {
+	switch {
+	case errors.Is(webErr.Err, context.Canceled):
+		return 503
+	case db.IsTimeout(webErr.Err):
+		return 504
+	}
+	return webErr.Status
+}
+
 // Shoddy content negotation for JSON preference.
 var preferJson = (func() func(http.Header) bool {
 	commaSepRegex := regexp.MustCompile(`\s*,\s*`)
 	htmlTypeRegex := regexp.MustCompile(`/html\b`)
-	jsonTypeRegex := regexp.MustCompile(`/json\b`)
+	jsonTypeRegex := regexp.MustCompile(`[/+]json\b`)
 	return func(header http.Header) bool {
 		// See if they prefer to accept JSON.
 		acceptHeader := header.Get("Accept")
@@ -25,6 +25,7 @@ func TestPreferJson(t *testing.T) {
 		{h{"Accept": {"text/html, *"}, "Content-Type": {"text/json"}}, false},
 		{h{"Accept": {"*"}, "Content-Type": {"text/json"}}, true},
 		{h{"Content-Type": {"text/json"}}, true},
+		{h{"Accept": {"application/problem+json"}}, true},
 	} {
 		assert.Equal(t, eg.expected, preferJson(http.Header(eg.acceptHeader)))
 	}
@@ -0,0 +1,382 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OpenAPIVersion   = "3.1.0"
+	APIV1Prefix      = "/api/v1"
+	APIV1Version     = "1.0.0"
+	APIV1OpenAPIPath = APIV1Prefix + "/openapi.json"
+)
+
+// Documentation for an /api/v1 route in the OpenAPI document, keyed by
+// method and path relative to the prefix, e.g. "GET /users/:id". The
+// request, response, and path parameters are zero values of their types,
+// and query parameters are the "form" fields of a struct.
+type apiOperation struct {
+	OperationId string
+	Summary     string
+	Params      map[string]any
+	Query       any
+	Request     any
+	RequestType string // Defaults to "application/json".
+	Status      int    // Defaults to 200.
+	Response    any
+	Deprecated  bool
+
+	ETag         bool   // The response has the resource's ETag header.
+	Precondition string // The conditional request header, "If-Match" or "If-None-Match".
+}
+
+var apiV1Operations = map[string]apiOperation{
+	"GET /users": {
+		OperationId: "listUsers",
+		Summary:     "List users",
+		Query:       ListUsersQuery{},
+		Response:    UserListDTO{},
+	},
+	"PUT /users": {
+		OperationId: "createUser",
+		Summary:     "Create a user",
+		Request:     NewUserDTO{},
+		Response:    UserDTO{},
+		ETag:        true,
+	},
+	"GET /users/:id": {
+		OperationId:  "getUser",
+		Summary:      "Get a user",
+		Params:       map[string]any{"id": 0},
+		Query:        GetUserQuery{},
+		Response:     UserDTO{},
+		ETag:         true,
+		Precondition: "If-None-Match",
+	},
+	"PUT /users/:id": {
+		OperationId:  "replaceUser",
+		Summary:      "Replace the email and password of a user",
+		Params:       map[string]any{"id": 0},
+		Request:      UpdateUserDTO{},
+		Response:     UserDTO{},
+		ETag:         true,
+		Precondition: "If-Match",
+	},
+	"PATCH /users/:id": {
+		OperationId:  "patchUser",
+		Summary:      "Change some fields of a user",
+		Params:       map[string]any{"id": 0},
+		Request:      PatchUserDTO{},
+		RequestType:  ContentTypeMergePatchJSON,
+		Response:     UserDTO{},
+		ETag:         true,
+		Precondition: "If-Match",
+	},
+	"POST /users/:id": {
+		OperationId:  "updateUser",
+		Summary:      "Replace the email and password of a user",
+		Params:       map[string]any{"id": 0},
+		Request:      UpdateUserDTO{},
+		Response:     UserDTO{},
+		Deprecated:   true,
+		ETag:         true,
+		Precondition: "If-Match",
+	},
+	"DELETE /users/:id": {
+		OperationId:  "deleteUser",
+		Summary:      "Delete a user, until it is restored or purged",
+		Params:       map[string]any{"id": 0},
+		Status:       204,
+		Precondition: "If-Match",
+	},
+	"POST /users/:id/restore": {
+		OperationId:  "restoreUser",
+		Summary:      "Restore a deleted user, unless a user has taken its email since",
+		Params:       map[string]any{"id": 0},
+		Response:     UserDTO{},
+		ETag:         true,
+		Precondition: "If-Match",
+	},
+}
+
+// Serve the OpenAPI document, without authentication so clients can be
+// generated from it.
+func (s *Server) ServeOpenAPI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, s.OpenAPI())
+	}
+}
+
+// An OpenAPI 3.1 document of the registered /api/v1 routes.
+func (s *Server) OpenAPI() gin.H {
+	schemas := gin.H{}
+	openAPISchema(reflect.TypeOf(Problem{}), schemas)
+	paths := gin.H{}
+	for _, route := range s.Routes() {
+		if !strings.HasPrefix(route.Path, APIV1Prefix+"/") || route.Path == APIV1OpenAPIPath {
+			continue
+		}
+		path := strings.TrimPrefix(route.Path, APIV1Prefix)
+		op, ok := apiV1Operations[route.Method+" "+path]
+		if !ok {
+			op.Summary = route.Method + " " + path
+		}
+
+		openAPIPath := routeParamRegex.ReplaceAllString(path, "{$1}")
+		if paths[openAPIPath] == nil {
+			paths[openAPIPath] = gin.H{}
+		}
+		paths[openAPIPath].(gin.H)[strings.ToLower(route.Method)] = op.openAPI(route.Method, path, schemas)
+	}
+
+	return gin.H{
+		"openapi": OpenAPIVersion,
+		"info": gin.H{
+			"title":   "webapp",
+			"version": APIV1Version,
+		},
+		"servers": []gin.H{{"url": s.Config.BaseURL + APIV1Prefix}},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas":         schemas,
+			"securitySchemes": gin.H{"basicAuth": gin.H{"type": "http", "scheme": "basic"}},
+		},
+		"security": []gin.H{{"basicAuth": []string{}}},
+	}
+}
+
+var routeParamRegex = regexp.MustCompile(`[:*](\w+)`)
+
+func (op apiOperation) openAPI(method, path string, schemas gin.H) gin.H {
+	status := op.Status
+	if status == 0 {
+		status = 200
+	}
+	response := gin.H{"description": http.StatusText(status)}
+	if op.Response != nil {
+		response["content"] = jsonContent(reflect.TypeOf(op.Response), schemas)
+	}
+	if op.ETag {
+		response["headers"] = gin.H{"ETag": gin.H{
+			"description": "The version of the resource, for If-Match and If-None-Match.",
+			"schema":      gin.H{"type": "string"},
+		}}
+	}
+	problem := gin.H{
+		"description": "Problem details",
+		"content":     gin.H{ContentTypeProblemJSON: gin.H{"schema": schemaRef("Problem")}},
+	}
+	responses := gin.H{strconv.Itoa(status): response, "default": problem}
+	operation := gin.H{"summary": op.Summary, "responses": responses}
+	if op.OperationId != "" {
+		operation["operationId"] = op.OperationId
+	}
+	if op.Deprecated {
+		operation["deprecated"] = true
+	}
+
+	var params []gin.H
+	for _, match := range routeParamRegex.FindAllStringSubmatch(path, -1) {
+		schema := gin.H{"type": "string"}
+		if param, ok := op.Params[match[1]]; ok {
+			schema = openAPISchema(reflect.TypeOf(param), schemas)
+		}
+		params = append(params, gin.H{"name": match[1], "in": "path", "required": true, "schema": schema})
+	}
+	if op.Query != nil {
+		params = append(params, queryParams(reflect.TypeOf(op.Query), schemas)...)
+	}
+	switch op.Precondition {
+	case "If-None-Match":
+		params = append(params, gin.H{
+			"name":        op.Precondition,
+			"in":          "header",
+			"description": "Responds 304 Not Modified while the resource has one of these ETags.",
+			"schema":      gin.H{"type": "string"},
+		})
+		responses["304"] = gin.H{"description": http.StatusText(304)}
+	case "If-Match":
+		params = append(params, gin.H{
+			"name":        op.Precondition,
+			"in":          "header",
+			"description": "Responds 412 Precondition Failed unless the resource has one of these ETags.",
+			"schema":      gin.H{"type": "string"},
+		})
+		responses["412"] = problem
+	}
+	if method != "GET" && method != "HEAD" {
+		params = append(params, gin.H{
+			"name":        HeaderIdempotencyKey,
+			"in":          "header",
+			"description": "Replays the response of an earlier request with the same key.",
+			"schema":      gin.H{"type": "string", "maxLength": maxIdempotencyKeyLength},
+		})
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if op.Request != nil {
+		content := jsonContent(reflect.TypeOf(op.Request), schemas)
+		if op.RequestType != "" {
+			content = gin.H{op.RequestType: content["application/json"]}
+		}
+		operation["requestBody"] = gin.H{"required": true, "content": content}
+	}
+	return operation
+}
+
+// The optional query parameters of a struct's "form" fields, with defaults.
+func queryParams(t reflect.Type, schemas gin.H) []gin.H {
+	var params []gin.H
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("form"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		schema := openAPISchema(fieldType, schemas)
+		addBindingRules(schema, field.Tag.Get("binding"))
+		if strings.HasPrefix(options, "default=") {
+			def := strings.TrimPrefix(options, "default=")
+			schema["default"] = def
+			if n, err := strconv.Atoi(def); err == nil {
+				schema["default"] = n
+			}
+		}
+		params = append(params, gin.H{"name": name, "in": "query", "schema": schema})
+	}
+	return params
+}
+
+func jsonContent(t reflect.Type, schemas gin.H) gin.H {
+	return gin.H{"application/json": gin.H{"schema": openAPISchema(t, schemas)}}
+}
+
+func schemaRef(name string) gin.H {
+	return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// The JSON schema of a type as encoded by encoding/json, with named structs
+// added to the component schemas and referenced.
+func openAPISchema(t reflect.Type, schemas gin.H) gin.H {
+	switch {
+	case t == timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return gin.H{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := openAPISchema(t.Elem(), schemas)
+		if typ, ok := schema["type"].(string); ok {
+			schema["type"] = []string{typ, "null"}
+			return schema
+		}
+		return gin.H{"oneOf": []gin.H{schema, {"type": "null"}}}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return gin.H{"type": "integer"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return gin.H{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "contentEncoding": "base64"}
+		}
+		return gin.H{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = gin.H{} // Placeholder for recursive types.
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return schemaRef(t.Name())
+	}
+	return gin.H{}
+}
+
+func structSchema(t reflect.Type, schemas gin.H) gin.H {
+	properties := gin.H{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := structSchema(field.Type, schemas)
+			for k, v := range embedded["properties"].(gin.H) {
+				properties[k] = v
+			}
+			required = append(required, embedded["required"].([]string)...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer && strings.Contains(options, "omitempty") {
+			fieldType = fieldType.Elem() // Omitted rather than null when nil.
+		}
+		properties[name] = openAPISchema(fieldType, schemas)
+		addBindingRules(properties[name].(gin.H), field.Tag.Get("binding"))
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	return gin.H{"type": "object", "properties": properties, "required": required}
+}
+
+// Describe the "binding" validation rules of a string or integer field in
+// its schema, as lengths or bounds respectively.
+func addBindingRules(schema gin.H, binding string) {
+	minimum, maximum := "minLength", "maxLength"
+	switch schema["type"] {
+	case "string":
+	case "integer":
+		minimum, maximum = "minimum", "maximum"
+	default:
+		return
+	}
+	for _, rule := range strings.Split(binding, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		n, err := strconv.Atoi(param)
+		switch {
+		case name == "email":
+			schema["format"] = "email"
+		case name == "min" && err == nil:
+			schema[minimum] = n
+		case name == "max" && err == nil:
+			schema[maximum] = n
+		}
+	}
+}
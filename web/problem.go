@@ -0,0 +1,73 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ContentTypeProblemJSON = "application/problem+json"
+
+	// Problem types of errors which clients may handle specially, others
+	// are "about:blank" and described by their status code.
+	ProblemTypeValidation = "urn:webapp:problem:validation"
+	ProblemTypeEmailTaken = "urn:webapp:problem:email-taken"
+)
+
+// An RFC 7807 problem details response body. The correlation ID is the
+// request ID, also in the X-Request-ID header, for finding its logs.
+type Problem struct {
+	Type          string       `json:"type"`
+	Title         string       `json:"title"`
+	Status        int          `json:"status"`
+	Detail        string       `json:"detail,omitempty"`
+	Instance      string       `json:"instance,omitempty"`
+	CorrelationId string       `json:"correlation_id,omitempty"`
+	Errors        []FieldError `json:"errors,omitempty"`
+
+	// Additional members, which can't replace the ones above.
+	Extensions map[string]any `json:"-"`
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	bs, err := json.Marshal(problem(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return bs, err
+	}
+	members := map[string]any{}
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+	if err := json.Unmarshal(bs, &members); err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// The problem details of an error. Only client errors show the error
+// message as the detail, since server errors may leak internals.
+func newProblem(c *gin.Context, webErr WebErr) Problem {
+	problem := Problem{
+		Type:       firstNonEmpty(webErr.Type, "about:blank"),
+		Title:      firstNonEmpty(webErr.Title, http.StatusText(webErr.Status)),
+		Status:     webErr.Status,
+		Detail:     webErr.Detail,
+		Instance:   c.Request.URL.Path,
+		Extensions: webErr.Extensions,
+	}
+	if id, ok := c.Get(ContextKeyRequestID); ok {
+		problem.CorrelationId, _ = id.(string)
+	}
+	if problem.Detail == "" && webErr.Status/100 == 4 && webErr.Err != nil {
+		problem.Detail = webErr.Err.Error()
+	}
+	var validationErr ValidationError
+	if errors.As(webErr.Err, &validationErr) {
+		problem.Errors = validationErr.Fields
+	}
+	return problem
+}
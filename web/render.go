@@ -0,0 +1,68 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSON object keys which are never sent in responses, at any depth, e.g.
+// the password hash of a generated model whose table has a password column.
+var sensitiveJSONKeys = map[string]bool{
+	"password":           true,
+	"password_hash":      true,
+	"password_digest":    true,
+	"encrypted_password": true,
+}
+
+// Respond with the JSON of an object, less any sensitive keys. Prefer it to
+// gin's c.JSON for anything read from the database.
+func renderJSON(c *gin.Context, status int, obj any) {
+	bs, err := redactedJSON(obj)
+	webMust(c, 500, err)
+	c.Data(status, "application/json; charset=utf-8", bs)
+}
+
+// The JSON of an object with its sensitive keys removed. Objects which can't
+// contain them are encoded as is, others lose the order of their keys.
+func redactedJSON(obj any) ([]byte, error) {
+	bs, err := json.Marshal(obj)
+	if err != nil || !mayContainSensitiveKeys(bs) {
+		return bs, err
+	}
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redact(value))
+}
+
+func mayContainSensitiveKeys(bs []byte) bool {
+	for key := range sensitiveJSONKeys {
+		if bytes.Contains(bs, []byte(`"`+key+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, member := range v {
+			if sensitiveJSONKeys[key] {
+				delete(v, key)
+			} else {
+				v[key] = redact(member)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redact(item)
+		}
+	}
+	return value
+}
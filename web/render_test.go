@@ -0,0 +1,72 @@
+package web
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"webapp/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactedJSON(t *testing.T) {
+	type account struct {
+		Name         string `json:"name"`
+		PasswordHash string `json:"password_hash"`
+	}
+	bs, err := redactedJSON(map[string]any{
+		"accounts": []account{{"alice", "$2a$10$hash"}},
+		"owner":    account{"bob", "$2a$10$hash"},
+		"password": "secret",
+		"count":    12345678901234567,
+	})
+	tmust(t, err)
+	assert.Equal(t, `{"accounts":[{"name":"alice"}],"count":12345678901234567,"owner":{"name":"bob"}}`, string(bs))
+
+	bs, err = redactedJSON(account{Name: "carol"})
+	tmust(t, err)
+	assert.Equal(t, `{"name":"carol"}`, string(bs))
+}
+
+// No user endpoint responds with a password, or its hash.
+func TestUserEndpointsOmitPasswords(t *testing.T) {
+	server, err := NewServer(Config{CookieEncryptionKeys: [][]byte{[]byte("0123456789abcdef0123456789abcdef")}}, nil)
+	tmust(t, err)
+	server.Users = db.NewMemoryUserRepository()
+	request := testRequester(server)
+
+	const password = "Secret123"
+	hash, err := BCryptPassword(password)
+	tmust(t, err)
+	user := seedTestUser(t, server, "alice@example.com", hash)
+
+	login := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"email":    {user.Email},
+		"password": {password},
+	}.Encode()))
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, login)
+	assert.Equal(t, 302, res.Code)
+	loginUser := httptest.NewRequest("GET", "/login/user", nil)
+	for _, cookie := range res.Result().Cookies() {
+		loginUser.AddCookie(cookie)
+	}
+
+	responses := map[string]*httptest.ResponseRecorder{
+		"list":       request("GET", "/api/v1/users", "", nil),
+		"create":     request("PUT", "/api/v1/users", `{"email":"bob@example.com","password":"Hunter2!!"}`, nil),
+		"get":        request("GET", "/api/v1/users/1", "", nil),
+		"update":     request("POST", "/api/v1/users/1", `{"email":"alice@example.com","password":"Passw0rd"}`, nil),
+		"login/user": httptest.NewRecorder(),
+	}
+	server.ServeHTTP(responses["login/user"], loginUser)
+
+	for name, res := range responses {
+		assert.Equal(t, 200, res.Code, name)
+		assert.Contains(t, res.Body.String(), `"email":`, name)
+		assert.NotContains(t, res.Body.String(), "password", name)
+		assert.NotContains(t, res.Body.String(), "$2a$", name)
+	}
+}
@@ -26,18 +26,23 @@ func (s *Server) ApplyRoutes() {
 	// Cookie based login.
 	s.GET("/login", func(ctx *gin.Context) { s.mustServeHTML(ctx, 200, "login.html") })
 	s.POST("/login", s.Login())
-	s.GET("/login/user", s.LoginAuth(), func(ctx *gin.Context) { ctx.JSON(200, s.loggedInUser(ctx)) })
+	s.GET("/login/user", s.LoginAuth(), s.LoginUser())
 	s.GET("/logout", s.Logout())
 
-	// API group example with basic auth.
+	// API group example with basic auth, described by a public OpenAPI document.
+	s.GET(APIV1OpenAPIPath, s.ServeOpenAPI())
 	accounts := gin.Accounts{"admin": "secret"}
-	apiv1 := s.Group("/api/v1", gin.BasicAuth(accounts))
+	apiv1 := s.Group(APIV1Prefix, gin.BasicAuth(accounts), s.Idempotency())
 	{
 		apiv1.GET("/users", s.ListUsers())
 		apiv1.PUT("/users", s.CreateUser())
 		apiv1.GET("/users/:id", s.GetUser())
-		apiv1.POST("/users/:id", s.UpdateUser())
+		apiv1.PUT("/users/:id", s.UpdateUser())
+		apiv1.PATCH("/users/:id", s.PatchUser())
+		apiv1.POST("/users/:id", s.UpdateUser()) // Deprecated, use PUT or PATCH.
 		apiv1.DELETE("/users/:id", s.DeleteUser())
+		apiv1.POST("/users/:id/restore", s.RestoreUser())
+		s.ApplyGeneratedRoutes(apiv1)
 	}
 }
 
@@ -67,17 +72,18 @@ func doPanic(c *gin.Context) {
 	panic(errors.New(message))
 }
 
-// Stream SQL query results as JSON lines.
+// Stream SQL query results as JSON lines from the read replica, if any.
 func (s *Server) dbQuery(c *gin.Context) {
 	bs, err := io.ReadAll(c.Request.Body)
 	webMust(c, 500, err)
 	query := string(bs)
 	log.Debugf("OK: query=%q", query)
 
-	rows, err := s.DB.Query(query)
+	rows, err := s.DB.Reader().QueryContext(c.Request.Context(), query)
 	if err != nil {
-		webMust(c, 400, fmt.Errorf("invalid query: %v", err))
+		webMust(c, 400, fmt.Errorf("invalid query: %w", err))
 	}
+	defer rows.Close()
 
 	columns, err := rows.Columns()
 	webMust(c, 500, err)
@@ -98,5 +104,6 @@ func (s *Server) dbQuery(c *gin.Context) {
 			Nulls:  true,
 		}))
 	}
+	webMust(c, 500, rows.Err())
 	log.Must(bufout.Flush())
 }
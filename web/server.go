@@ -1,7 +1,9 @@
 package web
 
 import (
+	"crypto/rand"
 	"embed"
+	"encoding/hex"
 	"errors"
 	"html/template"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"webapp/db"
 
@@ -23,12 +26,18 @@ type Server struct {
 	*gin.Engine
 	Config Config
 	DB     *db.DB
+	Users  db.UserRepository
 	FS     http.FileSystem
+
+	IdempotencyKeys db.IdempotencyKeyRepository
 }
 
 const (
 	PublicAssetsDirname = "public"
 	WebTemplatesDirname = "templates"
+
+	HeaderRequestID     = "X-Request-ID"
+	ContextKeyRequestID = "request_id"
 )
 
 //go:embed public/* templates/*
@@ -37,6 +46,7 @@ var embedFS embed.FS
 func NewServer(config Config, database *db.DB) (*Server, error) {
 	gin.SetMode(config.Mode)
 	engine := gin.New()
+	engine.Use(requestID())
 	if gin.Mode() == gin.ReleaseMode {
 		engine.Use(jsonLogger())
 	} else {
@@ -52,6 +62,10 @@ func NewServer(config Config, database *db.DB) (*Server, error) {
 		Config: config,
 		DB:     database,
 	}
+	if database != nil {
+		server.Users = db.NewUserRepository(database)
+		server.IdempotencyKeys = db.NewIdempotencyKeyRepository(database)
+	}
 
 	engine.Use(server.MustMiddleware())
 	engine.NoRoute(server.ServeStaticAssets())
@@ -107,7 +121,7 @@ func (s *Server) ServeStaticAssets() gin.HandlerFunc {
 }
 
 func (s *Server) notFound(c *gin.Context) {
-	panic(WebErr{c, 404, nil})
+	panic(WebErr{Context: c, Status: 404})
 }
 
 // TODO: convert to regular middleware
@@ -139,6 +153,7 @@ func jsonLogger() gin.HandlerFunc {
 		Latency       string `json:"latency"`
 		LatencyMicros int64  `json:"latency_us"`
 		ClientIP      string `json:"client_ip"`
+		RequestID     any    `json:"request_id,omitempty"`
 	}
 
 	return gin.LoggerWithFormatter(
@@ -152,10 +167,37 @@ func jsonLogger() gin.HandlerFunc {
 				Latency:       params.Latency.String(),
 				LatencyMicros: params.Latency.Microseconds(),
 				ClientIP:      params.ClientIP,
+				RequestID:     params.Keys[ContextKeyRequestID],
 			}) + "\n"
 		},
 	)
 }
+
+// Tag each request with an ID, taken from the client if valid, which is
+// echoed in the response and attached to its database queries along with
+// the matched route for correlating logs.
+func requestID() gin.HandlerFunc {
+	validRequestID := regexp.MustCompile(`^[\w.:-]{1,128}$`)
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = hex.EncodeToString(must1(randomBytes(12)))
+		}
+		c.Set(ContextKeyRequestID, id)
+		c.Header(HeaderRequestID, id)
+		c.Request = c.Request.WithContext(db.WithQueryTags(c.Request.Context(), db.QueryTags{
+			RequestID: id,
+			Route:     c.Request.Method + " " + c.FullPath(),
+		}))
+	}
+}
+
+func randomBytes(n int) ([]byte, error) {
+	bs := make([]byte, n)
+	_, err := rand.Read(bs)
+	return bs, err
+}
+
 func must1[T any](t T, err error) T {
 	log.Must(err)
 	return t
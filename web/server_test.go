@@ -2,12 +2,16 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,11 +64,13 @@ func Test404PreferJson(t *testing.T) {
 	req, err := http.NewRequest(http.MethodGet, "/notfound", nil)
 	tmust(t, err)
 	req.Header.Add("Accept", "application/json,*")
+	req.Header.Set(HeaderRequestID, "req-404")
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 404, res.Code)
-	assert.Equal(t, "text/json; charset=utf-8", res.Header().Get("Content-Type"))
-	assert.Equal(t, `{"error":"not found"}`, res.Body.String())
+	assert.Equal(t, ContentTypeProblemJSON, res.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"instance":"/notfound","correlation_id":"req-404"}`,
+		res.Body.String())
 }
 
 func Test500(t *testing.T) {
@@ -90,12 +96,68 @@ func Test500PreferJson(t *testing.T) {
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(http.MethodGet, "/panic", nil)
 	tmust(t, err)
-	req.Header.Add("Accept", "application/json,*")
+	req.Header.Add("Accept", "application/problem+json")
+	req.Header.Set(HeaderRequestID, "req-500")
 	server.ServeHTTP(res, req)
 
 	assert.Equal(t, 500, res.Code)
-	assert.Equal(t, "text/json; charset=utf-8", res.Header().Get("Content-Type"))
-	assert.Equal(t, `{"error":"internal server error"}`, res.Body.String())
+	assert.Equal(t, ContentTypeProblemJSON, res.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500,"instance":"/panic","correlation_id":"req-500"}`,
+		res.Body.String())
+}
+
+func TestQueryTimeoutPreferJson(t *testing.T) {
+	server := InitTestServer(t)
+	server.DB.QueryTimeout = 50 * time.Millisecond
+
+	res := httptest.NewRecorder()
+	query := `WITH RECURSIVE r(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM r WHERE i < 100000000) SELECT COUNT(*) FROM r`
+	req, err := http.NewRequest(http.MethodPost, "/query", strings.NewReader(query))
+	tmust(t, err)
+	req.Header.Add("Accept", "application/json")
+	server.ServeHTTP(res, req)
+
+	assert.Equal(t, 504, res.Code)
+	var problem Problem
+	tmust(t, json.Unmarshal(res.Body.Bytes(), &problem))
+	assert.Equal(t, "Gateway Timeout", problem.Title)
+	assert.Equal(t, 504, problem.Status)
+	assert.Empty(t, problem.Detail)
+	assert.Equal(t, res.Header().Get(HeaderRequestID), problem.CorrelationId)
+}
+
+func TestProblemDetails(t *testing.T) {
+	server, err := NewServer(Config{}, nil)
+	tmust(t, err)
+
+	// Client errors keep their status and detail, with any WebErr fields.
+	server.GET("/teapot", func(c *gin.Context) {
+		panic(WebErr{Context: c, Status: 418, Err: errors.New("short and stout"),
+			Type: "urn:test:teapot", Extensions: map[string]any{"spout": true, "status": 200}})
+	})
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/teapot", nil)
+	req.Header.Set(HeaderRequestID, "req-418")
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 418, res.Code)
+	assert.Equal(t, ContentTypeProblemJSON, res.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"urn:test:teapot","title":"I'm a teapot","status":418,"detail":"short and stout",
+		"instance":"/teapot","correlation_id":"req-418","spout":true}`, res.Body.String())
+
+	// Server errors keep their status, without details even if HTML is preferred.
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/panic?status=503&message=secret", nil))
+	assert.Equal(t, 503, res.Code)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.NotContains(t, res.Body.String(), "secret")
+
+	res = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/panic?status=503&message=secret", nil)
+	req.Header.Set("Accept", "application/json")
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 503, res.Code)
+	assert.Equal(t, ContentTypeProblemJSON, res.Header().Get("Content-Type"))
+	assert.NotContains(t, res.Body.String(), "secret")
 }
 
 func tmust(t *testing.T, err error) {
@@ -103,3 +165,33 @@ func tmust(t *testing.T, err error) {
 		t.Fatal(err)
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	server, err := NewServer(Config{}, nil)
+	tmust(t, err)
+
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/hello", nil)
+	tmust(t, err)
+	server.ServeHTTP(res, req)
+	assert.Regexp(t, `^[0-9a-f]{24}$`, res.Header().Get(HeaderRequestID))
+
+	for header, expected := range map[string]string{
+		"abc-123":     "abc-123",
+		"bad id\r\n":  "",
+		"":            "",
+		"a.b:c_d-123": "a.b:c_d-123",
+	} {
+		res := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/hello", nil)
+		tmust(t, err)
+		req.Header.Set(HeaderRequestID, header)
+		server.ServeHTTP(res, req)
+		if expected != "" {
+			assert.Equal(t, expected, res.Header().Get(HeaderRequestID))
+		} else {
+			assert.NotEqual(t, header, res.Header().Get(HeaderRequestID))
+			assert.NotEmpty(t, res.Header().Get(HeaderRequestID))
+		}
+	}
+}
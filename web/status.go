@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"webapp/db"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/maerics/golog"
@@ -12,11 +13,12 @@ import (
 )
 
 type StatusDTO struct {
-	Status string      `json:"status"`
-	Mode   string      `json:"mode"`
-	Build  BuildInfo   `json:"build"`
-	Net    NetworkInfo `json:"network"`
-	HTTP   HTTPInfo    `json:"http"`
+	Status string         `json:"status"`
+	Mode   string         `json:"mode"`
+	Build  BuildInfo      `json:"build"`
+	Net    NetworkInfo    `json:"network"`
+	HTTP   HTTPInfo       `json:"http"`
+	DB     *db.QueryStats `json:"db,omitempty"`
 }
 
 func (s *Server) Status() gin.HandlerFunc {
@@ -25,6 +27,11 @@ func (s *Server) Status() gin.HandlerFunc {
 		for k := range c.Request.Header {
 			headers[k] = c.Request.Header.Get(k)
 		}
+		var dbStats *db.QueryStats
+		if s.DB != nil {
+			stats := s.DB.QueryStats()
+			dbStats = &stats
+		}
 
 		c.Data(200,
 			"text/json; charset=utf-8",
@@ -39,6 +46,7 @@ func (s *Server) Status() gin.HandlerFunc {
 					URL:     c.Request.URL.String(),
 					Headers: headers,
 				},
+				DB: dbStats,
 			}, true)))
 	}
 }
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	log "github.com/maerics/golog"
+)
+
+// Name invalid fields by their JSON or query keys and register the custom "password"
+// tag with gin's validator, used by the "binding" struct tags.
+func init() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, key := range []string{"json", "form"} {
+				if name, _, _ := strings.Cut(field.Tag.Get(key), ","); name != "" && name != "-" {
+					return name
+				}
+			}
+			return ""
+		})
+		log.Must(v.RegisterValidation("password", validatePassword))
+	}
+}
+
+// Passwords need at least three of lowercase letters, uppercase letters,
+// digits, and other characters, in at most 72 bytes since bcrypt refuses
+// longer ones. The "max" tag counts characters, not bytes.
+func validatePassword(fl validator.FieldLevel) bool {
+	password := fl.Field().String()
+	if len(password) > maxPasswordBytes {
+		return false
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower+upper+digit+other >= 3
+}
+
+// A field which failed validation, by its JSON key, with a machine-readable
+// code like "invalid_email" and a message for people.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Every invalid field of a request, responded with 422 Unprocessable Entity
+// and the fields as the "errors" of the problem details.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e ValidationError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		fields[i] = field.Field + " " + field.Message
+	}
+	return "invalid request: " + strings.Join(fields, ", ")
+}
+
+// The codes and messages of validation tags, others use the tag as the code.
+var fieldErrorCodes = map[string]struct{ code, message string }{
+	"required": {"required", "is required"},
+	"email":    {"invalid_email", "must be a valid email address"},
+	"min":      {"too_short", "must be at least %v characters"},
+	"max":      {"too_long", "must be at most %v characters"},
+	"password": {"weak_password", "must mix at least three of lowercase, uppercase, digits, and symbols, in at most 72 bytes"},
+}
+
+func newValidationError(errs validator.ValidationErrors) ValidationError {
+	var verr ValidationError
+	for _, err := range errs {
+		code, message := err.Tag(), "is invalid"
+		if known, ok := fieldErrorCodes[err.Tag()]; ok {
+			code, message = known.code, known.message
+			if strings.Contains(message, "%v") {
+				message = fmt.Sprintf(message, err.Param())
+			}
+		}
+		verr.Fields = append(verr.Fields, FieldError{err.Field(), code, message})
+	}
+	return verr
+}
+
+// Bind a JSON request body, with 400 if it is malformed or 422 if it fails
+// the validation of its "binding" tags.
+func bindJSON(c *gin.Context, obj any) {
+	mustBeValid(c, c.ShouldBindJSON(obj))
+}
+
+func mustBeValid(c *gin.Context, err error) {
+	var errs validator.ValidationErrors
+	if errors.As(err, &errs) {
+		mustBeValid(c, newValidationError(errs))
+	}
+	var verr ValidationError
+	if errors.As(err, &verr) {
+		panic(WebErr{Context: c, Status: 422, Err: verr, Type: ProblemTypeValidation})
+	}
+	webMust(c, 400, err)
+}
+
+// Bind an RFC 7396 JSON merge patch request body into a struct of pointer
+// fields, which stay nil unless given. Members can't be removed with null
+// since every field is required, and other content types respond 415.
+func bindMergePatch(c *gin.Context, obj any) {
+	if c.ContentType() != ContentTypeMergePatchJSON {
+		c.Header("Accept-Patch", ContentTypeMergePatchJSON)
+		webMust(c, 415, fmt.Errorf("content type must be %q", ContentTypeMergePatchJSON))
+	}
+	body, err := c.GetRawData()
+	webMust(c, 400, err)
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil || members == nil {
+		webMust(c, 400, errors.New("merge patch must be a JSON object"))
+	}
+	var verr ValidationError
+	for _, name := range sortedKeys(members) {
+		if string(members[name]) == "null" {
+			verr.Fields = append(verr.Fields, FieldError{name, "required", "must not be null"})
+		}
+	}
+	if len(verr.Fields) > 0 {
+		mustBeValid(c, verr)
+	}
+
+	webMust(c, 400, json.Unmarshal(body, obj))
+	mustBeValid(c, binding.Validator.ValidateStruct(obj))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}